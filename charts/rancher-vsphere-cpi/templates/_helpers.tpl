@@ -15,7 +15,7 @@ merged with the prime config, e.g.:
 */}}
 {{- define "vsphere.image" -}}
 {{- $repo := .repository -}}
-{{- $tag := .tag -}}
+{{- $tag := .tag | default "latest" -}}
 {{- if and .prime .prime.enabled .primeRepository -}}
 {{- $repo = .primeRepository -}}
 {{- if .primeTag -}}
@@ -25,14 +25,105 @@ merged with the prime config, e.g.:
 {{- printf "%s:%s" $repo $tag -}}
 {{- end -}}
 
+{{/*
+Render "true" when a versionOverrides entry matches the version. Entries matching every
+version, such as the catch-all ">= 0.0.0-0", do not count. Takes
+(dict "overrides" .Values.versionOverrides "version" version).
+*/}}
+{{- define "hasVersionOverride" -}}
+{{- $version := .version -}}
+{{- range .overrides -}}
+{{- if and (semverCompare .constraint $version) (not (semverCompare .constraint "0.0.0-0")) -}}
+{{- "true" -}}
+{{- break -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Render the Kubernetes version the versionOverrides are matched against. The version skew
+policy of the cloud controller manager allows the CPI of the previous Kubernetes minor,
+so when versionSkewFallback is set and no entry matches the Kubernetes version, an entry
+matching the previous minor is used instead.
+*/}}
+{{- define "versionOverridesKubeVersion" -}}
+{{- $version := .Capabilities.KubeVersion.Version -}}
+{{- if and .Values.versionSkewFallback (not (include "hasVersionOverride" (dict "overrides" .Values.versionOverrides "version" $version))) -}}
+{{- $current := semver $version -}}
+{{- if $current.Minor -}}
+{{- $previous := printf "%d.%d.0" $current.Major (sub $current.Minor 1) -}}
+{{- if include "hasVersionOverride" (dict "overrides" .Values.versionOverrides "version" $previous) -}}
+{{- $version = $previous -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- $version -}}
+{{- end -}}
+
+{{/*
+Fail unless the Kubernetes version is within the catalog.cattle.io/kube-version range of
+the chart, which plain Helm ignores, and a versionOverrides entry selects its images,
+see hasVersionOverride and versionOverridesKubeVersion. The minor following the range
+passes when versionSkewFallback selects the entries of the previous, supported minor.
+allowUnsupportedKubeVersion skips the check.
+*/}}
+{{- define "kubeVersionGuard" -}}
+{{- if not .Values.allowUnsupportedKubeVersion -}}
+{{- $version := .Capabilities.KubeVersion.Version -}}
+{{- $supported := index .Chart.Annotations "catalog.cattle.io/kube-version" -}}
+{{- $overridesVersion := include "versionOverridesKubeVersion" . -}}
+{{- $skewed := and (ne $overridesVersion $version) (semverCompare $supported $overridesVersion) -}}
+{{- if not (or (semverCompare $supported $version) $skewed) -}}
+{{- fail (printf "Kubernetes %s is not supported by %s %s, which requires Kubernetes %s. Set allowUnsupportedKubeVersion to true to install it anyway." $version .Chart.Name .Chart.Version $supported) -}}
+{{- end -}}
+{{- if not (include "hasVersionOverride" (dict "overrides" .Values.versionOverrides "version" $overridesVersion)) -}}
+{{- fail (printf "no versionOverrides entry of %s %s matches Kubernetes %s, so its images are unknown. Add one, or set allowUnsupportedKubeVersion to true to install it anyway." .Chart.Name .Chart.Version $version) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
 {{- define "applyVersionOverrides" -}}
+{{- template "kubeVersionGuard" . -}}
+{{- $version := include "versionOverridesKubeVersion" . -}}
 {{- $overrides := dict -}}
 {{- range $override := .Values.versionOverrides -}}
-{{- if semverCompare $override.constraint $.Capabilities.KubeVersion.Version -}}
-{{- $_ := mergeOverwrite $overrides $override.values -}}
+{{- if semverCompare $override.constraint $version -}}
+{{- $_ := mergeOverwrite $overrides (deepCopy $override.values) -}}
+{{- end -}}
+{{- end -}}
+{{- template "fillUnset" (dict "dst" .Values "src" $overrides) -}}
+{{- end -}}
+
+{{/*
+Set the values of dst that are missing, null or an empty string to those of src,
+recursing into the maps of both. Takes (dict "dst" dst "src" src).
+*/}}
+{{- define "fillUnset" -}}
+{{- $dst := .dst -}}
+{{- range $key, $value := .src -}}
+{{- $current := index $dst $key -}}
+{{- if and (kindIs "map" $current) (kindIs "map" $value) -}}
+{{- template "fillUnset" (dict "dst" $current "src" $value) -}}
+{{- else if or (kindIs "invalid" $current) (and (kindIs "string" $current) (eq $current "")) -}}
+{{- $_ := set $dst $key $value -}}
+{{- end -}}
 {{- end -}}
 {{- end -}}
-{{- $_ := mergeOverwrite .Values $overrides -}}
+
+{{/*
+Render the entries of a map that are set, leaving out empty strings, false, zero and
+empty collections, so that a cloud config section without any value set is left out.
+*/}}
+{{- define "omitEmpty" -}}
+{{- $set := dict -}}
+{{- range $key, $value := . -}}
+{{- if $value -}}
+{{- $_ := set $set $key $value -}}
+{{- end -}}
+{{- end -}}
+{{- with $set -}}
+{{- toYaml . -}}
+{{- end -}}
 {{- end -}}
 
 {{/*
@@ -50,6 +141,110 @@ add below linux tolerations to workloads could be scheduled to those linux nodes
 kubernetes.io/os: linux
 {{- end -}}
 
+{{/*
+Node selector terms matching the control-plane nodes of the configured
+global.distribution. An empty distribution matches both RKE1 and RKE2 nodes.
+*/}}
+{{- define "controlplane-node-selector-terms" -}}
+{{- $distribution := .Values.global.distribution | default "" -}}
+{{- if not (has $distribution (list "" "rke1" "rke2" "k3s" "generic")) -}}
+{{- fail (printf "global.distribution must be one of rke1, rke2, k3s or generic, got %q" $distribution) -}}
+{{- end -}}
+{{- $notWindows := dict "key" "kubernetes.io/os" "operator" "NotIn" "values" (list "windows") -}}
+{{- $terms := list -}}
+{{- if or (eq $distribution "") (eq $distribution "rke1") -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/controlplane" "operator" "In" "values" (list "true")) $notWindows)) -}}
+{{- end -}}
+{{- if or (eq $distribution "") (eq $distribution "rke2") (eq $distribution "k3s") -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/control-plane" "operator" "In" "values" (list "true")) $notWindows)) -}}
+{{- end -}}
+{{- if eq $distribution "generic" -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/control-plane" "operator" "Exists") $notWindows)) -}}
+{{- end -}}
+{{- toYaml $terms -}}
+{{- end -}}
+
+{{/*
+Tolerations for the control-plane taints of the configured global.distribution.
+Only used when global.distribution is set.
+*/}}
+{{- define "controlplane-tolerations" -}}
+{{- $distribution := .Values.global.distribution | default "" -}}
+{{- if eq $distribution "rke1" -}}
+- key: node-role.kubernetes.io/controlplane
+  effect: NoSchedule
+  value: "true"
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  value: "true"
+{{- else if eq $distribution "rke2" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  operator: Exists
+- key: CriticalAddonsOnly
+  operator: Exists
+{{- else if eq $distribution "k3s" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/master
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  operator: Exists
+- key: CriticalAddonsOnly
+  operator: Exists
+{{- else if eq $distribution "generic" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/master
+  effect: NoSchedule
+  operator: Exists
+{{- end }}
+{{- end -}}
+
+{{/*
+Render an affinity that merges the user supplied affinity with the built-in
+control-plane node affinity. Every built-in node selector term is combined with
+every user term, so user expressions narrow down the control-plane nodes instead
+of replacing them. Pass a dict with the root context values, the user affinity
+and whether the built-in terms apply, e.g.:
+  {{ include "controlplane-affinity" (dict "Values" .Values "affinity" .Values.cloudControllerManager.affinity "builtin" true) }}
+*/}}
+{{- define "controlplane-affinity" -}}
+{{- $affinity := deepCopy (.affinity | default dict) -}}
+{{- if .builtin -}}
+{{- $builtin := include "controlplane-node-selector-terms" . | fromYamlArray -}}
+{{- $nodeAffinity := $affinity.nodeAffinity | default dict -}}
+{{- $required := $nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution | default dict -}}
+{{- $userTerms := $required.nodeSelectorTerms | default list -}}
+{{- $terms := $builtin -}}
+{{- if $userTerms -}}
+{{- $terms = list -}}
+{{- range $b := $builtin -}}
+{{- range $u := $userTerms -}}
+{{- $term := dict "matchExpressions" (concat $b.matchExpressions ($u.matchExpressions | default list)) -}}
+{{- with $u.matchFields -}}
+{{- $_ := set $term "matchFields" . -}}
+{{- end -}}
+{{- $terms = append $terms $term -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- $_ := set $required "nodeSelectorTerms" $terms -}}
+{{- $_ := set $nodeAffinity "requiredDuringSchedulingIgnoredDuringExecution" $required -}}
+{{- $_ := set $affinity "nodeAffinity" $nodeAffinity -}}
+{{- end -}}
+{{- with $affinity -}}
+{{- toYaml . -}}
+{{- end -}}
+{{- end -}}
+
 {{/*
 Create chart name and version as used by the chart label.
 */}}
@@ -67,3 +262,50 @@ helm.sh/chart: {{ include "chartName" . }}
 {{- end -}}
 
 
+{{/*
+NO_PROXY of the containers reaching vCenter through global.proxy: global.proxy.noProxy,
+the loopback and cluster domain names, the service CIDR and the API server addresses.
+When global.proxy.serviceCidr is empty, the service CIDR is looked up from the kubernetes
+ServiceCIDR and otherwise defaults to that of the distribution. The API server addresses
+are looked up from the endpoints of the kubernetes service, which is in the service CIDR.
+*/}}
+{{- define "proxy.noProxy" -}}
+{{- $entries := list -}}
+{{- range splitList "," .Values.global.proxy.noProxy -}}
+{{- $entries = append $entries (trim .) -}}
+{{- end -}}
+{{- $entries = concat $entries (list "127.0.0.1" "localhost" ".svc" ".cluster.local") -}}
+{{- $serviceCidr := .Values.global.proxy.serviceCidr -}}
+{{- if and (not $serviceCidr) (.Capabilities.APIVersions.Has "networking.k8s.io/v1/ServiceCIDR") -}}
+{{- with (lookup "networking.k8s.io/v1" "ServiceCIDR" "" "kubernetes").spec -}}
+{{- $serviceCidr = join "," .cidrs -}}
+{{- end -}}
+{{- end -}}
+{{- if not $serviceCidr -}}
+{{- $serviceCidr = eq .Values.global.distribution "generic" | ternary "10.96.0.0/12" "10.43.0.0/16" -}}
+{{- end -}}
+{{- $entries = concat $entries (splitList "," $serviceCidr) -}}
+{{- range (lookup "discovery.k8s.io/v1" "EndpointSlice" "default" "kubernetes").endpoints -}}
+{{- $entries = concat $entries .addresses -}}
+{{- end -}}
+{{- without (uniq $entries) "" | join "," -}}
+{{- end -}}
+
+{{/*
+Proxy environment variables of the containers reaching vCenter, rendered when
+global.proxy.httpProxy or global.proxy.httpsProxy is set.
+*/}}
+{{- define "proxy.env" -}}
+{{- with .Values.global.proxy -}}
+{{- if or .httpProxy .httpsProxy -}}
+{{- $env := list -}}
+{{- with .httpProxy -}}
+{{- $env = append $env (dict "name" "HTTP_PROXY" "value" .) -}}
+{{- end -}}
+{{- with .httpsProxy -}}
+{{- $env = append $env (dict "name" "HTTPS_PROXY" "value" .) -}}
+{{- end -}}
+{{- toYaml (append $env (dict "name" "NO_PROXY" "value" (include "proxy.noProxy" $))) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
@@ -0,0 +1,221 @@
+#!/bin/bash
+# Checks that every vCenter of the config is reachable the way the drivers reach it:
+# resolves its host, logs in over SOAP with the credentials and looks up its datacenters.
+# The first failure is reported as CONFIG, DNS, CONNECTION, TLS, AUTH or DATACENTER.
+#
+# Environment:
+#   CONFIG_FORMAT    cpi for the vsphere.yaml of the CPI, csi for the csi-vsphere.conf of the CSI
+#   CONFIG_FILE      path of the config
+#   CREDENTIALS_DIR  path of the mounted CPI credentials Secret, with <host>.username and
+#                    <host>.password keys, used when the config has no user and password
+#
+# The login is skipped for a vCenter whose credentials are only in the secretsDirectory of
+# the CPI, which the test cannot read; the vCenter is then only reached.
+set -o nounset -o pipefail
+
+fail() {
+  echo "FAILED ($1): $2" >&2
+  exit 1
+}
+
+# parse_cpi prints the global and vcenter settings of a vsphere.yaml as tab separated
+# "global key value" and "vcenter name key value" lines. Lists are printed as one line
+# per item. Values are printed with the escapes of printf %b, backslashes being doubled.
+parse_cpi() {
+  awk '
+    function escape(v,    out, i, c) {
+      out = ""
+      for (i = 1; i <= length(v); i++) {
+        c = substr(v, i, 1)
+        out = out (c == "\\" ? "\\\\" : c)
+      }
+      return out
+    }
+    function unquote(v) {
+      sub(/^[ \t]+/, "", v)
+      sub(/[ \t]+#.*$/, "", v)
+      sub(/[ \t]+$/, "", v)
+      if (v ~ /^".*"$/ || v ~ /^\047.*\047$/) v = substr(v, 2, length(v) - 2)
+      return escape(v)
+    }
+    /^[ \t]*(#|$)/ { next }
+    {
+      match($0, /^ */)
+      indent = RLENGTH
+      line = substr($0, indent + 1)
+    }
+    indent == 0 { section = line; sub(/:.*/, "", section); vcIndent = -1; key = ""; next }
+    section != "global" && section != "vcenter" { next }
+    line ~ /^- / { if (key != "") print prefix "\t" key "\t" unquote(substr(line, 3)); next }
+    {
+      k = line; sub(/:.*/, "", k)
+      v = line; sub(/^[^:]*:/, "", v)
+    }
+    section == "global" { key = k; prefix = "global"; if (unquote(v) != "") print prefix "\t" k "\t" unquote(v); next }
+    section == "vcenter" && (vcIndent < 0 || indent <= vcIndent) {
+      vcIndent = indent
+      name = line; sub(/:[ \t]*$/, "", name)
+      key = ""; prefix = "vcenter\t" unquote(name)
+      print prefix
+      next
+    }
+    section == "vcenter" { key = k; if (unquote(v) != "") print prefix "\t" k "\t" unquote(v) }
+  ' "$1"
+}
+
+# parse_csi prints the Global and VirtualCenter settings of a csi-vsphere.conf like
+# parse_cpi, with the keys renamed to those of vsphere.yaml. The \\, \n and \t escapes of
+# gcfg in quoted values are those of printf %b, so they are printed as is.
+parse_csi() {
+  awk '
+    function unquote(v,    out, i, c, quoted) {
+      sub(/^[ \t]+/, "", v)
+      sub(/[ \t]+$/, "", v)
+      quoted = v ~ /^".*"$/
+      if (quoted) v = substr(v, 2, length(v) - 2)
+      out = ""
+      for (i = 1; i <= length(v); i++) {
+        c = substr(v, i, 1)
+        if (c != "\\") { out = out c; continue }
+        if (!quoted) { out = out "\\\\"; continue }
+        c = substr(v, ++i, 1)
+        out = out (c == "\"" ? c : "\\" c)
+      }
+      return out
+    }
+    /^[ \t]*([#;]|$)/ { next }
+    /^[ \t]*\[/ {
+      section = $0
+      sub(/^[ \t]*\[[ \t]*/, "", section)
+      sub(/[ \t]*\][ \t]*$/, "", section)
+      if (tolower(section) == "global") { prefix = "global" }
+      else if (tolower(section) ~ /^virtualcenter[ \t]/) {
+        name = section; sub(/^[^ \t]+[ \t]+/, "", name)
+        prefix = "vcenter\t" unquote(name)
+        print prefix
+      } else { prefix = "" }
+      next
+    }
+    prefix != "" && /=/ {
+      k = $0; sub(/=.*/, "", k); k = unquote(k)
+      v = $0; sub(/^[^=]*=/, "", v)
+      if (k == "insecure-flag") k = "insecureFlag"
+      else if (k == "ca-file") k = "caFile"
+      print prefix "\t" k "\t" unquote(v)
+    }
+  ' "$1"
+}
+
+# xml_escape escapes a value for a SOAP request.
+xml_escape() {
+  local v=$1
+  # the replacements are quoted, bash 5.2 replaces an unquoted & with the match
+  v=${v//&/'&amp;'}
+  v=${v//</'&lt;'}
+  v=${v//>/'&gt;'}
+  v=${v//\"/'&quot;'}
+  v=${v//\'/'&apos;'}
+  printf '%s' "$v"
+}
+
+# soap sends a vim25 request to the vCenter of $url with the session cookie of $jar and
+# prints the response. curl failures are reported with their category.
+soap() {
+  local response code
+  response=$(curl --silent --show-error --max-time 30 ${curl_tls[@]+"${curl_tls[@]}"} \
+    --cookie "$jar" --cookie-jar "$jar" \
+    --header 'Content-Type: text/xml; charset=utf-8' --header 'SOAPAction: urn:vim25/6.7' \
+    --data-binary "<?xml version=\"1.0\" encoding=\"UTF-8\"?><soapenv:Envelope xmlns:soapenv=\"http://schemas.xmlsoap.org/soap/envelope/\" xmlns:urn=\"urn:vim25\"><soapenv:Body>$1</soapenv:Body></soapenv:Envelope>" \
+    "$url" 2>&1)
+  code=$?
+  case $code in
+    0) printf '%s' "$response" ;;
+    6) fail DNS "cannot resolve $server: $response" ;;
+    35 | 51 | 53 | 54 | 58 | 59 | 60 | 64 | 66 | 77 | 80 | 82 | 83 | 90 | 91)
+      fail TLS "cannot establish a trusted TLS connection to $server:$port: $response" ;;
+    *) fail CONNECTION "cannot reach $url: $response" ;;
+  esac
+}
+
+case ${CONFIG_FORMAT:-} in
+  cpi) settings=$(parse_cpi "$CONFIG_FILE") || fail CONFIG "cannot read $CONFIG_FILE" ;;
+  csi) settings=$(parse_csi "$CONFIG_FILE") || fail CONFIG "cannot read $CONFIG_FILE" ;;
+  *) fail CONFIG "CONFIG_FORMAT must be cpi or csi, got '${CONFIG_FORMAT:-}'" ;;
+esac
+
+# setting prints the value of key for the vCenter $name, falling back to the global one.
+setting() {
+  local value
+  value=$(awk -F '\t' -v name="$name" -v key="$1" '$1 == "vcenter" && $2 == name && $3 == key { print $4; exit }' <<<"$settings")
+  if [ -z "$value" ]; then
+    value=$(awk -F '\t' -v key="$1" '$1 == "global" && $2 == key { print $3; exit }' <<<"$settings")
+  fi
+  printf '%b' "$value"
+}
+
+names=$(awk -F '\t' '$1 == "vcenter" && NF == 2 { print $2 }' <<<"$settings")
+[ -n "$names" ] || fail CONFIG "no vCenter is configured in $CONFIG_FILE"
+
+jar=$(mktemp)
+trap 'rm -f "$jar"' EXIT
+
+while IFS= read -r name; do
+  server=$(setting server)
+  server=${server:-$(printf '%b' "$name")}
+  port=$(setting port)
+  port=${port:-443}
+  user=$(setting user)
+  password=$(setting password)
+  if [ -z "$user" ] && [ -n "${CREDENTIALS_DIR:-}" ] && [ -r "$CREDENTIALS_DIR/$server.username" ]; then
+    user=$(cat "$CREDENTIALS_DIR/$server.username")
+    password=$(cat "$CREDENTIALS_DIR/$server.password" 2>/dev/null)
+  fi
+  secrets_dir=$(setting secretsDirectory)
+  [ -n "$user" ] || [ -n "$secrets_dir" ] || fail AUTH "no username is configured for $server"
+  datacenters=$(printf '%b\n' "$(awk -F '\t' -v name="$name" '$1 == "vcenter" && $2 == name && $3 == "datacenters" { print $4 }' <<<"$settings")" | tr ',' '\n' | sed 's/^[ \t]*//; s/[ \t]*$//' | grep -v '^$')
+  [ -n "$datacenters" ] || fail DATACENTER "no datacenter is configured for $server"
+
+  if [[ $server == *:* ]]; then
+    url="https://[$server]:$port/sdk"
+  elif [[ $server =~ ^[0-9.]+$ ]]; then
+    url="https://$server:$port/sdk"
+  else
+    getent hosts "$server" >/dev/null || fail DNS "cannot resolve $server"
+    url="https://$server:$port/sdk"
+  fi
+
+  curl_tls=()
+  insecure=$(setting insecureFlag)
+  ca_file=$(setting caFile)
+  if [ "$insecure" = true ] || [ "$insecure" = 1 ]; then
+    curl_tls=(--insecure)
+  elif [ -n "$ca_file" ] && [ -r "$ca_file" ]; then
+    curl_tls=(--cacert "$ca_file")
+  elif [ -n "$ca_file" ] || [ -n "$(setting thumbprint)" ]; then
+    echo "WARNING: the CA file or thumbprint of $server is not available to the test, its certificate is not verified" >&2
+    curl_tls=(--insecure)
+  fi
+
+  : >"$jar"
+  if [ -z "$user" ]; then
+    response=$(soap '<urn:RetrieveServiceContent><urn:_this type="ServiceInstance">ServiceInstance</urn:_this></urn:RetrieveServiceContent>') || exit 1
+    [[ $response == *"<returnval>"* ]] || fail CONNECTION "$url did not answer as a vCenter: $response"
+    echo "OK: reached $server, the login and the datacenters are not checked as the credentials are in the secretsDirectory $secrets_dir of the cloud controller manager"
+    continue
+  fi
+  response=$(soap "<urn:Login><urn:_this type=\"SessionManager\">SessionManager</urn:_this><urn:userName>$(xml_escape "$user")</urn:userName><urn:password>$(xml_escape "$password")</urn:password></urn:Login>") || exit 1
+  case $response in
+    *InvalidLogin*) fail AUTH "vCenter $server rejected the username and password of $user" ;;
+    *"<faultstring>"*) fail AUTH "login to $server failed: $(sed 's/.*<faultstring>\(.*\)<\/faultstring>.*/\1/' <<<"$response")" ;;
+    *"<returnval>"*) ;;
+    *) fail CONNECTION "$url did not answer as a vCenter: $response" ;;
+  esac
+
+  while IFS= read -r datacenter; do
+    response=$(soap "<urn:FindByInventoryPath><urn:_this type=\"SearchIndex\">SearchIndex</urn:_this><urn:inventoryPath>$(xml_escape "${datacenter#/}")</urn:inventoryPath></urn:FindByInventoryPath>") || exit 1
+    [[ $response == *'type="Datacenter"'* ]] || fail DATACENTER "datacenter $datacenter is not found in $server"
+  done <<<"$datacenters"
+
+  soap '<urn:Logout><urn:_this type="SessionManager">SessionManager</urn:_this></urn:Logout>' >/dev/null || exit 1
+  echo "OK: logged in to $server as $user and found the datacenters $(paste -sd ' ' <<<"$datacenters")"
+done <<<"$names"
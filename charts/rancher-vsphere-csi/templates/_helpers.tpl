@@ -9,13 +9,14 @@
 {{/*
 Render "repository:tag" for an image, selecting the hardened Prime image when
 global.prime.enabled is true and a primeRepository is set. If primeTag is set,
-it is used as the image tag in Prime mode as well. Pass the image dict
-merged with the prime config, e.g.:
+it is used as the image tag in Prime mode as well. The tag is latest when neither
+the values nor the versionOverrides set it. Pass the image dict merged with the
+prime config, e.g.:
   {{ include "vsphere.image" (merge (dict "prime" .Values.global.prime) .Values.csiController.image) }}
 */}}
 {{- define "vsphere.image" -}}
 {{- $repo := .repository -}}
-{{- $tag := .tag -}}
+{{- $tag := .tag | default "latest" -}}
 {{- if and .prime .prime.enabled .primeRepository -}}
 {{- $repo = .primeRepository -}}
 {{- if .primeTag -}}
@@ -25,14 +26,117 @@ merged with the prime config, e.g.:
 {{- printf "%s:%s" $repo $tag -}}
 {{- end -}}
 
+{{/*
+Resolve a Windows image block. The repository and tag fields fall back to the
+matching Linux image, everything else comes from the Windows block, e.g.:
+  {{ include "windows.image" (dict "linux" .Values.csiNode.image "windows" .Values.csiNodeWindows.image) | fromYaml }}
+*/}}
+{{- define "windows.image" -}}
+{{- $image := pick .linux "repository" "primeRepository" "tag" "primeTag" -}}
+{{- range $key, $value := omit .windows "nodeDriverRegistrar" "livenessProbe" -}}
+{{- if $value -}}
+{{- $_ := set $image $key $value -}}
+{{- end -}}
+{{- end -}}
+{{- toYaml $image -}}
+{{- end -}}
+
+{{/*
+Render "true" when a versionOverrides entry matches the version. Entries matching every
+version, such as the catch-all ">= 0.0.0-0", do not count. Takes
+(dict "overrides" .Values.versionOverrides "version" version).
+*/}}
+{{- define "hasVersionOverride" -}}
+{{- $version := .version -}}
+{{- range .overrides -}}
+{{- if and (semverCompare .constraint $version) (not (semverCompare .constraint "0.0.0-0")) -}}
+{{- "true" -}}
+{{- break -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Fail unless the Kubernetes version is within the catalog.cattle.io/kube-version range of
+the chart, which plain Helm ignores, and a versionOverrides entry selects its images,
+see hasVersionOverride. allowUnsupportedKubeVersion skips the check.
+*/}}
+{{- define "kubeVersionGuard" -}}
+{{- if not .Values.allowUnsupportedKubeVersion -}}
+{{- $version := .Capabilities.KubeVersion.Version -}}
+{{- $supported := index .Chart.Annotations "catalog.cattle.io/kube-version" -}}
+{{- if not (semverCompare $supported $version) -}}
+{{- fail (printf "Kubernetes %s is not supported by %s %s, which requires Kubernetes %s. Set allowUnsupportedKubeVersion to true to install it anyway." $version .Chart.Name .Chart.Version $supported) -}}
+{{- end -}}
+{{- if not (include "hasVersionOverride" (dict "overrides" .Values.versionOverrides "version" $version)) -}}
+{{- fail (printf "no versionOverrides entry of %s %s matches Kubernetes %s, so its images are unknown. Add one, or set allowUnsupportedKubeVersion to true to install it anyway." .Chart.Name .Chart.Version $version) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Fill the values left unset with those of the versionOverrides matching the Kubernetes
+version, later entries taking precedence. Values the user sets always win. Calling it
+again has no effect, so every template using overridden values calls it first.
+*/}}
 {{- define "applyVersionOverrides" -}}
+{{- template "kubeVersionGuard" . -}}
 {{- $overrides := dict -}}
 {{- range $override := .Values.versionOverrides -}}
 {{- if semverCompare $override.constraint $.Capabilities.KubeVersion.Version -}}
-{{- $_ := mergeOverwrite $overrides $override.values -}}
+{{- $_ := mergeOverwrite $overrides (deepCopy $override.values) -}}
 {{- end -}}
 {{- end -}}
-{{- $_ := mergeOverwrite .Values $overrides -}}
+{{- template "fillUnset" (dict "dst" .Values "src" $overrides) -}}
+{{- end -}}
+
+{{/*
+Set the values of dst that are missing, null or an empty string to those of src,
+recursing into the maps of both. Takes (dict "dst" dst "src" src).
+*/}}
+{{- define "fillUnset" -}}
+{{- $dst := .dst -}}
+{{- range $key, $value := .src -}}
+{{- $current := index $dst $key -}}
+{{- if and (kindIs "map" $current) (kindIs "map" $value) -}}
+{{- template "fillUnset" (dict "dst" $current "src" $value) -}}
+{{- else if or (kindIs "invalid" $current) (and (kindIs "string" $current) (eq $current "")) -}}
+{{- $_ := set $dst $key $value -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Internal feature states of the driver, by feature state name. The states of the toggles
+such as listVolumes.enabled are overridden or extended by featureStates, which the
+matching versionOverrides may set. Call after applyVersionOverrides. Toggles left null
+by the values and the versionOverrides are disabled.
+*/}}
+{{- define "featureStates" -}}
+{{- $states := dict
+  "csi-migration" .Values.csiMigration.enabled
+  "csi-auth-check" .Values.csiAuthCheck.enabled
+  "online-volume-extend" .Values.onlineVolumeExtend.enabled
+  "trigger-csi-fullsync" .Values.triggerCsiFullsync.enabled
+  "async-query-volume" .Values.asyncQueryVolume.enabled
+  "improved-csi-idempotency" .Values.improvedCsiIdempotency.enabled
+  "improved-volume-topology" .Values.improvedVolumeTopology.enabled
+  "block-volume-snapshot" .Values.blockVolumeSnapshot.enabled
+  "csi-windows-support" .Values.csiWindowsSupport.enabled
+  "use-csinode-id" .Values.useCsinodeId.enabled
+  "list-volumes" (.Values.listVolumes.enabled | default false)
+  "pv-to-backingdiskobjectid-mapping" (.Values.pvToBackingdiskobjectidMapping.enabled | default false)
+  "cnsmgr-suspend-create-volume" .Values.cnsmgrSuspendCreateVolume.enabled
+  "topology-preferential-datastores" (.Values.topologyPreferentialDatastores.enabled | default false)
+  "max-pvscsi-targets-per-vm" .Values.maxPvscsiTargetsPerVm.enabled
+  "multi-vcenter-csi-topology" .Values.multiVcenterCsiTopology.enabled
+  "csi-internal-generated-cluster-id" .Values.csiInternalGeneratedClusterId.enabled
+-}}
+{{- /* set rather than merge, which does not override a true state with false */ -}}
+{{- range $name, $enabled := .Values.featureStates -}}
+{{- $_ := set $states $name $enabled -}}
+{{- end -}}
+{{- toYaml $states -}}
 {{- end -}}
 
 {{/*
@@ -50,6 +154,110 @@ add below linux tolerations to workloads could be scheduled to those linux nodes
 kubernetes.io/os: linux
 {{- end -}}
 
+{{/*
+Node selector terms matching the control-plane nodes of the configured
+global.distribution. An empty distribution matches both RKE1 and RKE2 nodes.
+*/}}
+{{- define "controlplane-node-selector-terms" -}}
+{{- $distribution := .Values.global.distribution | default "" -}}
+{{- if not (has $distribution (list "" "rke1" "rke2" "k3s" "generic")) -}}
+{{- fail (printf "global.distribution must be one of rke1, rke2, k3s or generic, got %q" $distribution) -}}
+{{- end -}}
+{{- $notWindows := dict "key" "kubernetes.io/os" "operator" "NotIn" "values" (list "windows") -}}
+{{- $terms := list -}}
+{{- if or (eq $distribution "") (eq $distribution "rke1") -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/controlplane" "operator" "In" "values" (list "true")) $notWindows)) -}}
+{{- end -}}
+{{- if or (eq $distribution "") (eq $distribution "rke2") (eq $distribution "k3s") -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/control-plane" "operator" "In" "values" (list "true")) $notWindows)) -}}
+{{- end -}}
+{{- if eq $distribution "generic" -}}
+{{- $terms = append $terms (dict "matchExpressions" (list (dict "key" "node-role.kubernetes.io/control-plane" "operator" "Exists") $notWindows)) -}}
+{{- end -}}
+{{- toYaml $terms -}}
+{{- end -}}
+
+{{/*
+Tolerations for the control-plane taints of the configured global.distribution.
+Only used when global.distribution is set.
+*/}}
+{{- define "controlplane-tolerations" -}}
+{{- $distribution := .Values.global.distribution | default "" -}}
+{{- if eq $distribution "rke1" -}}
+- key: node-role.kubernetes.io/controlplane
+  effect: NoSchedule
+  value: "true"
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  value: "true"
+{{- else if eq $distribution "rke2" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  operator: Exists
+- key: CriticalAddonsOnly
+  operator: Exists
+{{- else if eq $distribution "k3s" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/master
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/etcd
+  effect: NoExecute
+  operator: Exists
+- key: CriticalAddonsOnly
+  operator: Exists
+{{- else if eq $distribution "generic" -}}
+- key: node-role.kubernetes.io/control-plane
+  effect: NoSchedule
+  operator: Exists
+- key: node-role.kubernetes.io/master
+  effect: NoSchedule
+  operator: Exists
+{{- end }}
+{{- end -}}
+
+{{/*
+Render an affinity that merges the user supplied affinity with the built-in
+control-plane node affinity. Every built-in node selector term is combined with
+every user term, so user expressions narrow down the control-plane nodes instead
+of replacing them. Pass a dict with the root context values, the user affinity
+and whether the built-in terms apply, e.g.:
+  {{ include "controlplane-affinity" (dict "Values" .Values "affinity" .Values.cloudControllerManager.affinity "builtin" true) }}
+*/}}
+{{- define "controlplane-affinity" -}}
+{{- $affinity := deepCopy (.affinity | default dict) -}}
+{{- if .builtin -}}
+{{- $builtin := include "controlplane-node-selector-terms" . | fromYamlArray -}}
+{{- $nodeAffinity := $affinity.nodeAffinity | default dict -}}
+{{- $required := $nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution | default dict -}}
+{{- $userTerms := $required.nodeSelectorTerms | default list -}}
+{{- $terms := $builtin -}}
+{{- if $userTerms -}}
+{{- $terms = list -}}
+{{- range $b := $builtin -}}
+{{- range $u := $userTerms -}}
+{{- $term := dict "matchExpressions" (concat $b.matchExpressions ($u.matchExpressions | default list)) -}}
+{{- with $u.matchFields -}}
+{{- $_ := set $term "matchFields" . -}}
+{{- end -}}
+{{- $terms = append $terms $term -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
+{{- $_ := set $required "nodeSelectorTerms" $terms -}}
+{{- $_ := set $nodeAffinity "requiredDuringSchedulingIgnoredDuringExecution" $required -}}
+{{- $_ := set $affinity "nodeAffinity" $nodeAffinity -}}
+{{- end -}}
+{{- with $affinity -}}
+{{- toYaml . -}}
+{{- end -}}
+{{- end -}}
+
 {{/*
 Create chart name and version as used by the chart label.
 */}}
@@ -65,3 +273,137 @@ app.kubernetes.io/version: {{ .Chart.AppVersion | quote }}
 app.kubernetes.io/managed-by: {{ .Release.Service }}
 helm.sh/chart: {{ include "chartName" . }}
 {{- end -}}
+
+{{/*
+Returns "true" when certificates are issued by cert-manager rather than self-signed by Helm.
+*/}}
+{{- define "certManager.enabled" -}}
+{{- if and .Values.certManager.enabled (.Capabilities.APIVersions.Has "cert-manager.io/v1") -}}
+true
+{{- end -}}
+{{- end -}}
+
+{{/*
+Renders a cert-manager Certificate for the first of the given DNS names.
+Takes (dict "root" $ "name" name "secretName" secretName "dnsNames" list).
+*/}}
+{{- define "certManager.certificate" -}}
+apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: {{ .name }}
+  namespace: {{ .root.Release.Namespace }}
+  labels:
+    {{- include "labels" .root | nindent 4 }}
+spec:
+  secretName: {{ .secretName }}
+  commonName: {{ first .dnsNames }}
+  dnsNames:
+    {{- toYaml .dnsNames | nindent 4 }}
+  issuerRef:
+  {{- with .root.Values.certManager.issuerRef }}
+    {{- toYaml . | nindent 4 }}
+  {{- else }}
+    name: vsphere-csi-selfsigned
+    kind: Issuer
+  {{- end }}
+{{- end -}}
+
+{{/*
+Returns the base64 encoded ca.crt, tls.crt and tls.key of a self-signed certificate for the
+given DNS names. The data of an existing secret is reused so upgrades do not rotate it.
+Takes (dict "root" $ "secretName" secretName "dnsNames" list "days" validity).
+*/}}
+{{- define "selfSigned.certificate" -}}
+{{- $secret := lookup "v1" "Secret" .root.Release.Namespace .secretName }}
+{{- if and $secret $secret.data (index $secret.data "ca.crt") -}}
+ca.crt: {{ index $secret.data "ca.crt" }}
+tls.crt: {{ index $secret.data "tls.crt" }}
+tls.key: {{ index $secret.data "tls.key" }}
+{{- else }}
+{{- $ca := genCA (printf "%s-ca" .secretName) (int .days) }}
+{{- $cert := genSignedCert (first .dnsNames) nil .dnsNames (int .days) $ca -}}
+ca.crt: {{ $ca.Cert | b64enc }}
+tls.crt: {{ $cert.Cert | b64enc }}
+tls.key: {{ $cert.Key | b64enc }}
+{{- end -}}
+{{- end -}}
+
+{{/*
+Renders a kubernetes.io/tls Secret from the output of selfSigned.certificate.
+Takes (dict "root" $ "secretName" secretName "data" data).
+*/}}
+{{- define "selfSigned.secret" -}}
+apiVersion: v1
+kind: Secret
+type: kubernetes.io/tls
+metadata:
+  name: {{ .secretName }}
+  namespace: {{ .root.Release.Namespace }}
+  labels:
+    {{- include "labels" .root | nindent 4 }}
+data:
+  {{- toYaml .data | nindent 2 }}
+{{- end -}}
+
+{{/*
+Quotes a value of csi-vsphere.conf. The driver reads the file with gcfg, which only
+understands the \\, \", \n and \t escapes, so the Go escapes of the quote function break
+values such as passwords with control or non-printable characters. gcfg drops carriage
+returns and rejects NUL characters even when quoted, so these fail the render instead.
+*/}}
+{{- define "gcfg.quote" -}}
+{{- $value := toString . -}}
+{{- if or (contains "\r" $value) (contains "\x00" $value) -}}
+{{- fail "csi-vsphere.conf values cannot contain carriage return or NUL characters" -}}
+{{- end -}}
+{{- $value | replace "\\" "\\\\" | replace "\"" "\\\"" | replace "\n" "\\n" | replace "\t" "\\t" | printf "\"%s\"" -}}
+{{- end -}}
+
+{{/*
+NO_PROXY of the containers reaching vCenter through global.proxy: global.proxy.noProxy,
+the loopback and cluster domain names, the service CIDR and the API server addresses.
+When global.proxy.serviceCidr is empty, the service CIDR is looked up from the kubernetes
+ServiceCIDR and otherwise defaults to that of the distribution. The API server addresses
+are looked up from the endpoints of the kubernetes service, which is in the service CIDR.
+*/}}
+{{- define "proxy.noProxy" -}}
+{{- $entries := list -}}
+{{- range splitList "," .Values.global.proxy.noProxy -}}
+{{- $entries = append $entries (trim .) -}}
+{{- end -}}
+{{- $entries = concat $entries (list "127.0.0.1" "localhost" ".svc" ".cluster.local") -}}
+{{- $serviceCidr := .Values.global.proxy.serviceCidr -}}
+{{- if and (not $serviceCidr) (.Capabilities.APIVersions.Has "networking.k8s.io/v1/ServiceCIDR") -}}
+{{- with (lookup "networking.k8s.io/v1" "ServiceCIDR" "" "kubernetes").spec -}}
+{{- $serviceCidr = join "," .cidrs -}}
+{{- end -}}
+{{- end -}}
+{{- if not $serviceCidr -}}
+{{- $serviceCidr = eq .Values.global.distribution "generic" | ternary "10.96.0.0/12" "10.43.0.0/16" -}}
+{{- end -}}
+{{- $entries = concat $entries (splitList "," $serviceCidr) -}}
+{{- range (lookup "discovery.k8s.io/v1" "EndpointSlice" "default" "kubernetes").endpoints -}}
+{{- $entries = concat $entries .addresses -}}
+{{- end -}}
+{{- without (uniq $entries) "" | join "," -}}
+{{- end -}}
+
+{{/*
+Proxy environment variables of the containers reaching vCenter, rendered when
+global.proxy.httpProxy or global.proxy.httpsProxy is set.
+*/}}
+{{- define "proxy.env" -}}
+{{- with .Values.global.proxy -}}
+{{- if or .httpProxy .httpsProxy -}}
+{{- $env := list -}}
+{{- with .httpProxy -}}
+{{- $env = append $env (dict "name" "HTTP_PROXY" "value" .) -}}
+{{- end -}}
+{{- with .httpsProxy -}}
+{{- $env = append $env (dict "name" "HTTPS_PROXY" "value" .) -}}
+{{- end -}}
+{{- toYaml (append $env (dict "name" "NO_PROXY" "value" (include "proxy.noProxy" $))) -}}
+{{- end -}}
+{{- end -}}
+{{- end -}}
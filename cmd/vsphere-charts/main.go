@@ -0,0 +1,89 @@
+// Command vsphere-charts provides offline tooling for the vSphere charts.
+//
+// Usage:
+//
+//	vsphere-charts resolve -chart <path> -kube-version <version> [-prime] [-registry <registry>] [-allow-unsupported-kube-version] [-images]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/rancher/vsphere-charts/pkg/values"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		usage(stderr)
+		return fmt.Errorf("missing command")
+	}
+	switch args[0] {
+	case "resolve":
+		return resolve(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return nil
+	default:
+		usage(stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, `Usage: vsphere-charts <command> [flags]
+
+Commands:
+  resolve   print the effective values and image references of a chart for a Kubernetes version`)
+}
+
+// resolve prints the values of a chart after its versionOverrides are applied and the
+// image references they render.
+func resolve(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	opts := values.ResolveOptions{}
+	flags.StringVar(&opts.ChartPath, "chart", "", "path of the chart directory")
+	flags.StringVar(&opts.KubeVersion, "kube-version", "", "Kubernetes version of the cluster, such as 1.36 or v1.36.1+rke2r1")
+	flags.BoolVar(&opts.Prime, "prime", false, "use the Prime repositories and tags (global.prime.enabled)")
+	flags.StringVar(&opts.Registry, "registry", "", "registry prefixed to every image (global.cattle.systemDefaultRegistry)")
+	flags.BoolVar(&opts.AllowUnsupportedKubeVersion, "allow-unsupported-kube-version", false, "resolve a Kubernetes version the chart does not support (allowUnsupportedKubeVersion)")
+	imagesOnly := flags.Bool("images", false, "only print the image references, one per line")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if opts.ChartPath == "" || opts.KubeVersion == "" {
+		flags.Usage()
+		return fmt.Errorf("-chart and -kube-version are required")
+	}
+
+	resolution, err := values.Resolve(opts)
+	if err != nil {
+		return err
+	}
+	for _, warning := range resolution.Warnings {
+		fmt.Fprintln(stderr, "warning:", warning)
+	}
+	if *imagesOnly {
+		for _, path := range slices.Sorted(maps.Keys(resolution.Images)) {
+			fmt.Fprintf(stdout, "%s: %s\n", path, resolution.Images[path])
+		}
+		return nil
+	}
+	data, err := resolution.YAML()
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(data)
+	return err
+}
@@ -0,0 +1,361 @@
+// Package lint checks the manifests rendered by the charts against the practices the
+// charts follow, such as pinned image tags and the common labels on every workload.
+//
+// Findings are reported by template and line, the line being the one printed by
+// helm template --show-only <template>. A rule is suppressed for an object by listing
+// its name in the IgnoreAnnotation annotation of the object.
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IgnoreAnnotation lists the comma separated names of the rules not checked for an object.
+const IgnoreAnnotation = "vsphere-charts.rancher.io/lint-ignore"
+
+// Options select the rules that only apply to some installs.
+type Options struct {
+	// Hardened checks the rules of hardened clusters, which require resource requests and
+	// limits on every container. The charts leave them unset by default.
+	Hardened bool
+}
+
+// Finding is a rule violated by a rendered object.
+type Finding struct {
+	Rule     string
+	Template string
+	Line     int
+	// Object is the kind and name of the object, such as DaemonSet/vsphere-csi-node.
+	Object  string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", f.Template, f.Line, f.Object, f.Message, f.Rule)
+}
+
+// Rule is a check run on every rendered object.
+type Rule struct {
+	Name        string
+	Description string
+	check       func(m *manifest, opts Options) []issue
+}
+
+// issue is a rule violation at a node of a manifest.
+type issue struct {
+	node    *yaml.Node
+	message string
+}
+
+// manifest is a rendered object and its position in the output of its template.
+type manifest struct {
+	template string
+	// offset is the line of the --- separator of the object.
+	offset int
+	kind   string
+	name   string
+	root   *yaml.Node
+}
+
+// Rules returns the rules checked by Lint.
+func Rules() []Rule {
+	return []Rule{
+		{
+			Name:        "container-resources",
+			Description: "every container sets resource requests and limits on hardened clusters",
+			check:       checkContainerResources,
+		},
+		{
+			Name:        "image-tag",
+			Description: "no image uses the latest tag or omits its tag",
+			check:       checkImageTag,
+		},
+		{
+			Name:        "workload-labels",
+			Description: "every workload and pod template has the labels of the labels helper",
+			check:       checkWorkloadLabels,
+		},
+		{
+			Name:        "host-path",
+			Description: "hostPath volumes only mount the kubelet, device and CSI proxy paths of the CSI node plugin",
+			check:       checkHostPath,
+		},
+		{
+			Name:        "privileged-container",
+			Description: "only the vsphere-csi-node DaemonSet runs privileged containers",
+			check:       checkPrivileged,
+		},
+	}
+}
+
+// Lint checks the output of helm template against every rule.
+func Lint(output string, opts Options) ([]Finding, error) {
+	manifests, err := parse(output)
+	if err != nil {
+		return nil, err
+	}
+	var findings []Finding
+	for _, m := range manifests {
+		ignored := strings.Split(scalar(get(m.root, "metadata", "annotations", IgnoreAnnotation)), ",")
+		for _, rule := range Rules() {
+			if slices.ContainsFunc(ignored, func(name string) bool { return strings.TrimSpace(name) == rule.Name }) {
+				continue
+			}
+			for _, issue := range rule.check(m, opts) {
+				findings = append(findings, Finding{
+					Rule:     rule.Name,
+					Template: m.template,
+					Line:     m.offset + issue.node.Line,
+					Object:   m.kind + "/" + m.name,
+					Message:  issue.message,
+				})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// parse splits the output of helm template into manifests, numbering the lines of each
+// template the way helm template --show-only does.
+func parse(output string) ([]*manifest, error) {
+	var documents [][]string
+	for _, line := range strings.Split(output, "\n") {
+		if line == "---" || documents == nil {
+			documents = append(documents, nil)
+			if line == "---" {
+				continue
+			}
+		}
+		documents[len(documents)-1] = append(documents[len(documents)-1], line)
+	}
+
+	var manifests []*manifest
+	var errs []error
+	lines := map[string]int{}
+	for _, document := range documents {
+		template := ""
+		for _, line := range document {
+			if source, ok := strings.CutPrefix(line, "# Source: "); ok {
+				template = source
+				break
+			}
+		}
+		offset := lines[template] + 1
+		lines[template] = offset + len(document)
+
+		var root yaml.Node
+		if err := yaml.Unmarshal([]byte(strings.Join(document, "\n")), &root); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", template, err))
+			continue
+		}
+		if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		manifests = append(manifests, &manifest{
+			template: template,
+			offset:   offset,
+			kind:     scalar(get(root.Content[0], "kind")),
+			name:     scalar(get(root.Content[0], "metadata", "name")),
+			root:     root.Content[0],
+		})
+	}
+	return manifests, errors.Join(errs...)
+}
+
+// podTemplate returns the pod template of a workload, or the pod itself.
+func podTemplate(m *manifest) *yaml.Node {
+	switch m.kind {
+	case "Deployment", "DaemonSet", "StatefulSet", "ReplicaSet", "Job":
+		return get(m.root, "spec", "template")
+	case "CronJob":
+		return get(m.root, "spec", "jobTemplate", "spec", "template")
+	case "Pod":
+		return m.root
+	}
+	return nil
+}
+
+// containers returns the init containers and containers of a workload.
+func containers(m *manifest) []*yaml.Node {
+	template := podTemplate(m)
+	if template == nil {
+		return nil
+	}
+	var nodes []*yaml.Node
+	for _, key := range []string{"initContainers", "containers"} {
+		if list := get(template, "spec", key); list != nil && list.Kind == yaml.SequenceNode {
+			nodes = append(nodes, list.Content...)
+		}
+	}
+	return nodes
+}
+
+func checkContainerResources(m *manifest, opts Options) []issue {
+	if !opts.Hardened {
+		return nil
+	}
+	var issues []issue
+	for _, container := range containers(m) {
+		for _, key := range []string{"requests", "limits"} {
+			if resources := get(container, "resources", key); resources == nil || len(resources.Content) == 0 {
+				issues = append(issues, issue{container, fmt.Sprintf("container %q has no resource %s", scalar(get(container, "name")), key)})
+			}
+		}
+	}
+	return issues
+}
+
+func checkImageTag(m *manifest, _ Options) []issue {
+	var issues []issue
+	for _, container := range containers(m) {
+		image := get(container, "image")
+		if image == nil {
+			continue
+		}
+		reference := scalar(image)
+		if strings.Contains(reference, "@") {
+			continue
+		}
+		tag := ""
+		if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+			tag = reference[i+1:]
+		}
+		if tag == "" || tag == "latest" {
+			issues = append(issues, issue{image, fmt.Sprintf("image %q of container %q is not pinned to a tag", reference, scalar(get(container, "name")))})
+		}
+	}
+	return issues
+}
+
+// helperLabels are the labels rendered by the labels helper of both charts.
+var helperLabels = []string{"app.kubernetes.io/version", "app.kubernetes.io/managed-by", "helm.sh/chart"}
+
+func checkWorkloadLabels(m *manifest, _ Options) []issue {
+	template := podTemplate(m)
+	if template == nil {
+		return nil
+	}
+	type metadata struct {
+		object string
+		node   *yaml.Node
+	}
+	objects := []metadata{{m.kind, get(m.root, "metadata")}}
+	if template != m.root {
+		objects = append(objects, metadata{"pod template", get(template, "metadata")})
+	}
+	var issues []issue
+	for _, metadata := range objects {
+		if metadata.node == nil {
+			issues = append(issues, issue{template, fmt.Sprintf("%s has no metadata", metadata.object)})
+			continue
+		}
+		labels := get(metadata.node, "labels")
+		for _, label := range helperLabels {
+			if get(labels, label) == nil {
+				at := metadata.node
+				if labels != nil {
+					at = labels
+				}
+				issues = append(issues, issue{at, fmt.Sprintf("%s has no %s label, include the labels helper", metadata.object, label)})
+			}
+		}
+	}
+	return issues
+}
+
+// hostPaths are the host paths the CSI node plugins mount. Kubelet paths may be prefixed
+// by csiNode.prefixPath or csiNode.prefixPathWindows, so they match as suffixes.
+var (
+	hostPaths = []string{
+		"/dev",
+		"/sys/block",
+		"/sys/devices",
+		`\\.\pipe\csi-proxy-disk-v1`,
+		`\\.\pipe\csi-proxy-volume-v1`,
+		`\\.\pipe\csi-proxy-filesystem-v1`,
+		`\\.\pipe\csi-proxy-system-v1alpha1`,
+	}
+	kubeletPaths = []string{
+		"/var/lib/kubelet",
+		"/var/lib/kubelet/plugins_registry",
+		"/var/lib/kubelet/plugins/csi.vsphere.vmware.com",
+	}
+)
+
+func checkHostPath(m *manifest, _ Options) []issue {
+	// only the vsphere-csi-node and vsphere-csi-node-windows DaemonSets mount these paths
+	nodePlugin := m.kind == "DaemonSet" && strings.HasPrefix(m.name, "vsphere-csi-node")
+	template := podTemplate(m)
+	volumes := get(template, "spec", "volumes")
+	if volumes == nil || volumes.Kind != yaml.SequenceNode {
+		return nil
+	}
+	var issues []issue
+	for _, volume := range volumes.Content {
+		path := get(volume, "hostPath", "path")
+		if path == nil {
+			continue
+		}
+		if !nodePlugin || !knownHostPath(scalar(path)) {
+			issues = append(issues, issue{path, fmt.Sprintf("volume %q mounts host path %q, which is not a CSI node plugin path", scalar(get(volume, "name")), scalar(path))})
+		}
+	}
+	return issues
+}
+
+func knownHostPath(path string) bool {
+	if slices.Contains(hostPaths, path) {
+		return true
+	}
+	normalized := strings.TrimSuffix(strings.ReplaceAll(path, `\`, "/"), "/")
+	for _, kubeletPath := range kubeletPaths {
+		if strings.HasSuffix(normalized, kubeletPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPrivileged(m *manifest, _ Options) []issue {
+	if m.kind == "DaemonSet" && m.name == "vsphere-csi-node" {
+		return nil
+	}
+	var issues []issue
+	for _, container := range containers(m) {
+		if privileged := get(container, "securityContext", "privileged"); scalar(privileged) == "true" {
+			issues = append(issues, issue{privileged, fmt.Sprintf("container %q is privileged", scalar(get(container, "name")))})
+		}
+	}
+	return issues
+}
+
+// get returns the node at the path of mapping keys below node, or nil.
+func get(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				value = node.Content[i+1]
+				break
+			}
+		}
+		node = value
+	}
+	return node
+}
+
+// scalar returns the value of a scalar node, or an empty string.
+func scalar(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
@@ -0,0 +1,186 @@
+// Package rbac compares the RBAC rules rendered by the charts with the permission matrix
+// checked in for each chart, so that a role only gains a permission when the matrix is
+// widened with it.
+//
+// The matrix of a chart, matrix/<chart>.yaml, lists the rules of every role the chart
+// renders: the rules granted by every install under base, and the rules granted only
+// when a feature is enabled under the values path of the feature, such as
+// blockVolumeSnapshot.enabled. A rule listed under several features is granted when any
+// of them is enabled.
+package rbac
+
+import (
+	"embed"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed matrix/*.yaml
+var matrices embed.FS
+
+// Base is the matrix entry of the rules granted whatever the enabled features.
+const Base = "base"
+
+// Matrix is the permission matrix of a chart.
+type Matrix struct {
+	// Roles maps the kind and name of every role, such as ClusterRole/vsphere-csi-node-cluster-role,
+	// to its rules by feature.
+	Roles map[string]map[string][]rbacv1.PolicyRule `json:"roles"`
+}
+
+// Permission is a single verb granted on a resource, or on a non-resource URL.
+type Permission struct {
+	APIGroup       string
+	Resource       string
+	ResourceName   string
+	NonResourceURL string
+	Verb           string
+}
+
+func (p Permission) String() string {
+	if p.NonResourceURL != "" {
+		return p.Verb + " " + p.NonResourceURL
+	}
+	resource := p.Resource
+	if p.APIGroup != "" {
+		resource += "." + p.APIGroup
+	}
+	if p.ResourceName != "" {
+		resource += "/" + p.ResourceName
+	}
+	return p.Verb + " " + resource
+}
+
+// Load returns the permission matrix of a chart, such as rancher-vsphere-csi.
+func Load(chart string) (*Matrix, error) {
+	data, err := matrices.ReadFile("matrix/" + chart + ".yaml")
+	if err != nil {
+		return nil, fmt.Errorf("no permission matrix for chart %s: %w", chart, err)
+	}
+	var m Matrix
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("matrix/%s.yaml: %w", chart, err)
+	}
+	return &m, nil
+}
+
+// Features returns the values paths of the features the matrix grants rules for, sorted.
+func (m *Matrix) Features() []string {
+	var features []string
+	for _, rules := range m.Roles {
+		for feature := range rules {
+			if feature != Base && !slices.Contains(features, feature) {
+				features = append(features, feature)
+			}
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Expected returns the permissions of every role when the given features are enabled.
+// Roles without any permission are left out, as the charts do not render them.
+func (m *Matrix) Expected(enabled map[string]bool) map[string][]Permission {
+	expected := map[string][]Permission{}
+	for role, features := range m.Roles {
+		var rules []rbacv1.PolicyRule
+		for feature, featureRules := range features {
+			if feature == Base || enabled[feature] {
+				rules = append(rules, featureRules...)
+			}
+		}
+		if permissions := Flatten(rules); len(permissions) > 0 {
+			expected[role] = permissions
+		}
+	}
+	return expected
+}
+
+// Rendered returns the permissions of the Roles and ClusterRoles in the output of helm
+// template, by kind and name.
+func Rendered(output string) (map[string][]Permission, error) {
+	rules := map[string][]rbacv1.PolicyRule{}
+	for _, manifest := range strings.Split(output, "\n---\n") {
+		var object struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Rules []rbacv1.PolicyRule `json:"rules"`
+		}
+		if err := yaml.Unmarshal([]byte(manifest), &object); err != nil {
+			return nil, err
+		}
+		if object.Kind != "Role" && object.Kind != "ClusterRole" {
+			continue
+		}
+		role := object.Kind + "/" + object.Metadata.Name
+		rules[role] = append(rules[role], object.Rules...)
+	}
+	rendered := map[string][]Permission{}
+	for role, roleRules := range rules {
+		rendered[role] = Flatten(roleRules)
+	}
+	return rendered, nil
+}
+
+// Flatten expands rules into their distinct permissions, sorted.
+func Flatten(rules []rbacv1.PolicyRule) []Permission {
+	var permissions []Permission
+	for _, rule := range rules {
+		for _, verb := range rule.Verbs {
+			for _, url := range rule.NonResourceURLs {
+				permissions = append(permissions, Permission{NonResourceURL: url, Verb: verb})
+			}
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					names := rule.ResourceNames
+					if len(names) == 0 {
+						names = []string{""}
+					}
+					for _, name := range names {
+						permissions = append(permissions, Permission{APIGroup: group, Resource: resource, ResourceName: name, Verb: verb})
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].String() < permissions[j].String() })
+	return slices.Compact(permissions)
+}
+
+// Diff returns the differences between the expected and actual permissions of the
+// roles, one line per role and permission, sorted. Permissions granted beyond the
+// matrix are reported as widened.
+func Diff(expected, actual map[string][]Permission) []string {
+	var diff []string
+	for role, permissions := range actual {
+		if _, ok := expected[role]; !ok {
+			diff = append(diff, fmt.Sprintf("%s: role is not in the permission matrix", role))
+			continue
+		}
+		for _, p := range permissions {
+			if !slices.Contains(expected[role], p) {
+				diff = append(diff, fmt.Sprintf("%s: widened with %s", role, p))
+			}
+		}
+	}
+	for role, permissions := range expected {
+		if _, ok := actual[role]; !ok {
+			diff = append(diff, fmt.Sprintf("%s: role is not rendered", role))
+			continue
+		}
+		for _, p := range permissions {
+			if !slices.Contains(actual[role], p) {
+				diff = append(diff, fmt.Sprintf("%s: missing %s", role, p))
+			}
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
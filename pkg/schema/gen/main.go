@@ -0,0 +1,338 @@
+// Command gen vendors the Kubernetes OpenAPI schemas used by package schema.
+//
+// For every Kubernetes minor supported by the charts it downloads the k8s.io/kubernetes
+// and k8s.io/api modules of the first release of that minor from the Go module proxy,
+// keeps the definitions reachable from the kinds in rootKinds and writes them to
+// openapi/v1.<minor>.json. Run it with go generate ./pkg/schema.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/rancher/vsphere-charts/pkg/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// rootKinds are the kinds whose definitions are vendored, in every group and version
+// served by a release. Add a kind here before a chart renders it.
+var rootKinds = []string{
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"ConfigMap",
+	"CronJob",
+	"CSIDriver",
+	"CustomResourceDefinition",
+	"DaemonSet",
+	"Deployment",
+	"Job",
+	"MutatingWebhookConfiguration",
+	"NetworkPolicy",
+	"Pod",
+	"PodDisruptionBudget",
+	"PriorityClass",
+	"Role",
+	"RoleBinding",
+	"Secret",
+	"Service",
+	"ServiceAccount",
+	"StatefulSet",
+	"StorageClass",
+	"ValidatingWebhookConfiguration",
+}
+
+// keptKeys are the schema keywords used by the validator; everything else, descriptions
+// included, is dropped to keep the vendored files small.
+var keptKeys = []string{"$ref", "additionalProperties", "allOf", "enum", "format", "items", "properties", "required", "type"}
+
+// deprecatedField matches the descriptions of deprecated fields.
+var deprecatedField = regexp.MustCompile(`(?i)\bdeprecated(:|\.|\s+as\s+of)|\b(is|was)\s+deprecated\b`)
+
+func main() {
+	charts := flag.String("charts", "../../charts", "directory of the charts")
+	out := flag.String("out", "openapi", "directory the schemas are written to")
+	flag.Parse()
+
+	minors, err := supportedMinors(*charts)
+	if err != nil {
+		fail(err)
+	}
+	for _, minor := range minors {
+		version := fmt.Sprintf("v1.%d.0", minor)
+		fmt.Fprintln(os.Stderr, "vendoring", version)
+		file, err := vendor(version)
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", version, err))
+		}
+		data, err := json.MarshalIndent(file, "", " ")
+		if err != nil {
+			fail(err)
+		}
+		if err := os.WriteFile(filepath.Join(*out, fmt.Sprintf("v1.%d.json", minor)), append(data, '\n'), 0o644); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
+
+// supportedMinors returns the Kubernetes 1.x minors matching the
+// catalog.cattle.io/kube-version annotation of any chart in dir.
+func supportedMinors(dir string) ([]int, error) {
+	charts, err := filepath.Glob(filepath.Join(dir, "*", "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var minors []int
+	for _, chartFile := range charts {
+		data, err := os.ReadFile(chartFile)
+		if err != nil {
+			return nil, err
+		}
+		var chart struct {
+			Annotations map[string]string `json:"annotations"`
+		}
+		if err := yaml.Unmarshal(data, &chart); err != nil {
+			return nil, fmt.Errorf("%s: %w", chartFile, err)
+		}
+		constraint, err := semver.NewConstraint(chart.Annotations["catalog.cattle.io/kube-version"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", chartFile, err)
+		}
+		for minor := 0; minor < 100; minor++ {
+			if constraint.Check(semver.MustParse(fmt.Sprintf("1.%d", minor))) && !slices.Contains(minors, minor) {
+				minors = append(minors, minor)
+			}
+		}
+	}
+	if len(minors) == 0 {
+		return nil, fmt.Errorf("no chart with a catalog.cattle.io/kube-version annotation in %s", dir)
+	}
+	slices.Sort(minors)
+	return minors, nil
+}
+
+// vendor builds the schema file of a Kubernetes release.
+func vendor(version string) (*schema.File, error) {
+	kubernetes, err := download("k8s.io/kubernetes", version)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFile(kubernetes, "k8s.io/kubernetes@"+version+"/api/openapi-spec/swagger.json")
+	if err != nil {
+		return nil, err
+	}
+	var swagger struct {
+		Definitions map[string]map[string]interface{} `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &swagger); err != nil {
+		return nil, err
+	}
+	apiVersion := "v0." + strings.TrimPrefix(version, "v1.")
+	api, err := download("k8s.io/api", apiVersion)
+	if err != nil {
+		return nil, err
+	}
+	lifecycles, err := readLifecycles(api, "k8s.io/api@"+apiVersion+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	file := &schema.File{KubernetesVersion: version, Definitions: map[string]interface{}{}}
+	var roots []string
+	for name, definition := range swagger.Definitions {
+		gvks, _ := definition["x-kubernetes-group-version-kind"].([]interface{})
+		if len(gvks) != 1 {
+			continue
+		}
+		gvk := gvks[0].(map[string]interface{})
+		kind := schema.Kind{
+			Group:   gvk["group"].(string),
+			Version: gvk["version"].(string),
+			Kind:    gvk["kind"].(string),
+		}
+		properties, _ := definition["properties"].(map[string]interface{})
+		if _, ok := properties["metadata"]; !ok || strings.HasSuffix(kind.Kind, "List") {
+			// lists, options and status types such as DeleteOptions or Status
+			continue
+		}
+		if lifecycle, ok := lifecycles[name]; ok {
+			kind.Deprecated, kind.Replacement = lifecycle.deprecated, lifecycle.replacement
+		}
+		if slices.Contains(rootKinds, kind.Kind) {
+			kind.Definition = name
+			roots = append(roots, name)
+		}
+		file.Kinds = append(file.Kinds, kind)
+	}
+	slices.SortFunc(file.Kinds, func(a, b schema.Kind) int {
+		return strings.Compare(a.Group+"/"+a.Version+"/"+a.Kind, b.Group+"/"+b.Version+"/"+b.Kind)
+	})
+
+	for len(roots) > 0 {
+		name := roots[0]
+		roots = roots[1:]
+		if _, ok := file.Definitions[name]; ok {
+			continue
+		}
+		definition, ok := swagger.Definitions[name]
+		if !ok {
+			return nil, fmt.Errorf("missing definition %s", name)
+		}
+		trimmed := trim(definition).(map[string]interface{})
+		file.Definitions[name] = trimmed
+		roots = append(roots, refs(trimmed)...)
+	}
+	return file, nil
+}
+
+// trim drops the keywords not in keptKeys from a schema and marks the properties whose
+// description says they are deprecated.
+func trim(node interface{}) interface{} {
+	object, ok := node.(map[string]interface{})
+	if !ok {
+		return node
+	}
+	trimmed := map[string]interface{}{}
+	for _, key := range keptKeys {
+		value, ok := object[key]
+		if !ok {
+			continue
+		}
+		switch key {
+		case "properties":
+			properties := map[string]interface{}{}
+			for name, property := range value.(map[string]interface{}) {
+				p := trim(property).(map[string]interface{})
+				if description, _ := property.(map[string]interface{})["description"].(string); deprecatedField.MatchString(description) {
+					p["deprecated"] = true
+				}
+				properties[name] = p
+			}
+			trimmed[key] = properties
+		case "allOf":
+			var schemas []interface{}
+			for _, s := range value.([]interface{}) {
+				schemas = append(schemas, trim(s))
+			}
+			trimmed[key] = schemas
+		case "additionalProperties", "items":
+			trimmed[key] = trim(value)
+		default:
+			trimmed[key] = value
+		}
+	}
+	return trimmed
+}
+
+// refs returns the definition names referenced by a trimmed schema.
+func refs(node interface{}) []string {
+	var names []string
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				names = append(names, strings.TrimPrefix(ref, "#/definitions/"))
+				continue
+			}
+			names = append(names, refs(value)...)
+		}
+	case []interface{}:
+		for _, value := range node {
+			names = append(names, refs(value)...)
+		}
+	}
+	return names
+}
+
+type lifecycle struct {
+	deprecated  string
+	replacement string
+}
+
+var (
+	lifecycleDeprecated  = regexp.MustCompile(`func \(in \*(\w+)\) APILifecycleDeprecated\(\) \(major, minor int\) \{\s*return (\d+), (\d+)`)
+	lifecycleReplacement = regexp.MustCompile(`func \(in \*(\w+)\) APILifecycleReplacement\(\) schema\.GroupVersionKind \{\s*return schema\.GroupVersionKind\{Group: "([^"]*)", Version: "([^"]*)", Kind: "([^"]*)"\}`)
+)
+
+// readLifecycles reads the deprecation releases generated by prerelease-lifecycle-gen
+// in the k8s.io/api module, keyed by OpenAPI definition name.
+func readLifecycles(archive *zip.Reader, prefix string) (map[string]lifecycle, error) {
+	lifecycles := map[string]lifecycle{}
+	for _, f := range archive.File {
+		if path.Base(f.Name) != "zz_generated.prerelease-lifecycle.go" {
+			continue
+		}
+		data, err := readFile(archive, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		pkg := "io.k8s.api." + strings.ReplaceAll(path.Dir(strings.TrimPrefix(f.Name, prefix)), "/", ".") + "."
+		for _, match := range lifecycleDeprecated.FindAllSubmatch(data, -1) {
+			major, _ := strconv.Atoi(string(match[2]))
+			minor, _ := strconv.Atoi(string(match[3]))
+			l := lifecycles[pkg+string(match[1])]
+			l.deprecated = fmt.Sprintf("%d.%d", major, minor)
+			lifecycles[pkg+string(match[1])] = l
+		}
+		for _, match := range lifecycleReplacement.FindAllSubmatch(data, -1) {
+			l := lifecycles[pkg+string(match[1])]
+			apiVersion := string(match[3])
+			if group := string(match[2]); group != "" {
+				apiVersion = group + "/" + apiVersion
+			}
+			l.replacement = apiVersion + " " + string(match[4])
+			lifecycles[pkg+string(match[1])] = l
+		}
+	}
+	return lifecycles, nil
+}
+
+// download fetches a module zip from the first HTTP proxy in GOPROXY.
+func download(module, version string) (*zip.Reader, error) {
+	proxy := "https://proxy.golang.org"
+	for _, entry := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(r rune) bool { return r == ',' || r == '|' }) {
+		if strings.HasPrefix(entry, "http") {
+			proxy = strings.TrimSuffix(entry, "/")
+			break
+		}
+	}
+	response, err := http.Get(proxy + "/" + module + "/@v/" + version + ".zip")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s@%s: %s", module, version, response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+func readFile(archive *zip.Reader, name string) ([]byte, error) {
+	f, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,345 @@
+// Package schema validates rendered manifests against the OpenAPI schemas of the
+// Kubernetes releases supported by the charts, without a cluster.
+//
+// The schemas are vendored in openapi/, one file per minor, and hold only the kinds the
+// charts may render. Regenerate them with go generate ./pkg/schema after adding a kind
+// to the generator or widening the catalog.cattle.io/kube-version annotation.
+package schema
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+//go:generate go run ./gen
+
+//go:embed openapi/*.json
+var openapi embed.FS
+
+const (
+	quantityDefinition = "io.k8s.apimachinery.pkg.api.resource.Quantity"
+	intOrStringFormat  = "int-or-string"
+)
+
+// File is the vendored schema of a Kubernetes release.
+type File struct {
+	KubernetesVersion string `json:"kubernetesVersion"`
+	// Kinds are the kinds served by the release.
+	Kinds []Kind `json:"kinds"`
+	// Definitions are the OpenAPI definitions reachable from the vendored kinds.
+	Definitions map[string]interface{} `json:"definitions"`
+}
+
+// Kind is a kind served by a Kubernetes release.
+type Kind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+	// Definition is the OpenAPI definition of the kind, empty when it is not vendored.
+	Definition string `json:"definition,omitempty"`
+	// Deprecated is the Kubernetes minor the API version of the kind is deprecated in.
+	Deprecated string `json:"deprecated,omitempty"`
+	// Replacement is the apiVersion and kind to use instead of a deprecated one.
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// APIVersion returns the apiVersion of the kind as written in manifests.
+func (k Kind) APIVersion() string {
+	if k.Group == "" {
+		return k.Version
+	}
+	return k.Group + "/" + k.Version
+}
+
+// Schema validates manifests for a Kubernetes release.
+type Schema struct {
+	version     *semver.Version
+	kinds       map[string]Kind
+	groups      map[string]bool
+	definitions map[string]map[string]interface{}
+}
+
+// Violation is a field of a manifest that does not match the schema.
+type Violation struct {
+	// Field is the path of the field, such as spec.template.spec.containers[0].image.
+	Field   string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Field == "" {
+		return v.Message
+	}
+	return v.Field + ": " + v.Message
+}
+
+// Load returns the schema of the Kubernetes minor of kubeVersion, such as 1.36 or
+// v1.36.1+rke2r1.
+func Load(kubeVersion string) (*Schema, error) {
+	version, err := semver.NewVersion(kubeVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kubernetes version %q: %w", kubeVersion, err)
+	}
+	data, err := openapi.ReadFile(fmt.Sprintf("openapi/v%d.%d.json", version.Major(), version.Minor()))
+	if err != nil {
+		return nil, fmt.Errorf("no vendored schema for Kubernetes %d.%d, run go generate ./pkg/schema", version.Major(), version.Minor())
+	}
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	s := &Schema{
+		version:     version,
+		kinds:       map[string]Kind{},
+		groups:      map[string]bool{},
+		definitions: map[string]map[string]interface{}{},
+	}
+	for _, kind := range file.Kinds {
+		s.kinds[kind.APIVersion()+" "+kind.Kind] = kind
+		s.groups[kind.Group] = true
+	}
+	for name, definition := range file.Definitions {
+		s.definitions[name], _ = definition.(map[string]interface{})
+	}
+	return s, nil
+}
+
+// Versions returns the Kubernetes minors with a vendored schema, such as 1.36.
+func Versions() ([]string, error) {
+	entries, err := openapi.ReadDir("openapi")
+	if err != nil {
+		return nil, err
+	}
+	var versions []*semver.Version
+	for _, entry := range entries {
+		version, err := semver.NewVersion(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("openapi/%s: %w", entry.Name(), err)
+		}
+		versions = append(versions, version)
+	}
+	slices.SortFunc(versions, func(a, b *semver.Version) int { return a.Compare(b) })
+	var minors []string
+	for _, version := range versions {
+		minors = append(minors, fmt.Sprintf("%d.%d", version.Major(), version.Minor()))
+	}
+	return minors, nil
+}
+
+// Validate checks a manifest decoded from JSON. Unknown fields, wrong types, missing
+// required fields, deprecated fields and API versions that are deprecated or not served
+// by the release are reported. Manifests of groups the release does not serve, such as
+// custom resources, are not validated.
+func (s *Schema) Validate(object map[string]interface{}) []Violation {
+	apiVersion, _ := object["apiVersion"].(string)
+	kindName, _ := object["kind"].(string)
+	if apiVersion == "" || kindName == "" {
+		return []Violation{{Message: "apiVersion and kind must be set"}}
+	}
+	kind, ok := s.kinds[apiVersion+" "+kindName]
+	if !ok {
+		group := ""
+		if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+			group = apiVersion[:i]
+		}
+		if !s.groups[group] {
+			return nil
+		}
+		return []Violation{{Field: "apiVersion", Message: fmt.Sprintf("%s %s is not served by Kubernetes %s", apiVersion, kindName, s.minor())}}
+	}
+	if kind.Definition == "" {
+		return []Violation{{Field: "kind", Message: fmt.Sprintf("no vendored schema for %s %s, add it to the generator in pkg/schema/gen", apiVersion, kindName)}}
+	}
+
+	var violations []Violation
+	if kind.Deprecated != "" && s.version.Compare(semver.MustParse(kind.Deprecated)) >= 0 {
+		message := fmt.Sprintf("%s %s is deprecated since Kubernetes %s", apiVersion, kindName, kind.Deprecated)
+		if kind.Replacement != "" {
+			message += ", use " + kind.Replacement
+		}
+		violations = append(violations, Violation{Field: "apiVersion", Message: message})
+	}
+	return append(violations, s.validate(map[string]interface{}{"$ref": "#/definitions/" + kind.Definition}, object, "")...)
+}
+
+func (s *Schema) minor() string {
+	return fmt.Sprintf("%d.%d", s.version.Major(), s.version.Minor())
+}
+
+// validate checks value against node, a schema of the vendored definitions.
+func (s *Schema) validate(node map[string]interface{}, value interface{}, path string) []Violation {
+	if value == nil {
+		return nil
+	}
+	if ref, ok := node["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		if name == quantityDefinition {
+			return s.validateQuantity(value, path)
+		}
+		definition, ok := s.definitions[name]
+		if !ok {
+			return []Violation{{Field: path, Message: "missing definition " + name}}
+		}
+		return s.validate(definition, value, path)
+	}
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		var violations []Violation
+		for _, schema := range allOf {
+			schema, _ := schema.(map[string]interface{})
+			violations = append(violations, s.validate(schema, value, path)...)
+		}
+		return violations
+	}
+
+	typ, _ := node["type"].(string)
+	if typ == "" && node["properties"] != nil {
+		typ = "object"
+	}
+	var violations []Violation
+	switch typ {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []Violation{expected(path, "object", value)}
+		}
+		violations = s.validateObject(node, object, path)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []Violation{expected(path, "array", value)}
+		}
+		items, _ := node["items"].(map[string]interface{})
+		for i, item := range array {
+			violations = append(violations, s.validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		format, _ := node["format"].(string)
+		switch value := value.(type) {
+		case string:
+			if format == "byte" {
+				if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+					violations = append(violations, Violation{Field: path, Message: "must be base64 encoded"})
+				}
+			}
+		case float64:
+			if format != intOrStringFormat || value != math.Trunc(value) {
+				return []Violation{expected(path, "string", value)}
+			}
+		default:
+			return []Violation{expected(path, "string", value)}
+		}
+	case "integer":
+		if number, ok := value.(float64); !ok || number != math.Trunc(number) {
+			return []Violation{expected(path, "integer", value)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []Violation{expected(path, "number", value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []Violation{expected(path, "boolean", value)}
+		}
+	default:
+		// schemas without a type, such as JSON or RawExtension, accept any value
+		return nil
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok && !slices.Contains(enum, value) {
+		violations = append(violations, Violation{Field: path, Message: fmt.Sprintf("unsupported value %v, must be one of %v", value, enum)})
+	}
+	return violations
+}
+
+// validateObject checks the fields of an object, rejecting the fields not in the schema.
+func (s *Schema) validateObject(node, object map[string]interface{}, path string) []Violation {
+	properties, _ := node["properties"].(map[string]interface{})
+	var violations []Violation
+	for _, field := range sortedKeys(object) {
+		if property, ok := properties[field].(map[string]interface{}); ok {
+			fieldPath := join(path, field)
+			if deprecated, _ := property["deprecated"].(bool); deprecated && object[field] != nil {
+				violations = append(violations, Violation{Field: fieldPath, Message: "field is deprecated"})
+			}
+			violations = append(violations, s.validate(property, object[field], fieldPath)...)
+			continue
+		}
+		switch additional := node["additionalProperties"].(type) {
+		case map[string]interface{}:
+			violations = append(violations, s.validate(additional, object[field], fmt.Sprintf("%s[%s]", path, field))...)
+		case bool:
+			if !additional {
+				violations = append(violations, Violation{Field: join(path, field), Message: "unknown field"})
+			}
+		default:
+			violations = append(violations, Violation{Field: join(path, field), Message: "unknown field"})
+		}
+	}
+	required, _ := node["required"].([]interface{})
+	for _, field := range required {
+		if _, ok := object[field.(string)]; !ok {
+			violations = append(violations, Violation{Field: join(path, field.(string)), Message: "required field is missing"})
+		}
+	}
+	return violations
+}
+
+var quantity = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)(([KMGTPE]i)|[numkMGTPE]|([eE][+-]?[0-9]+))?$`)
+
+// validateQuantity checks a resource quantity such as 100m or 1Gi. Plain numbers are
+// accepted as the API server does.
+func (s *Schema) validateQuantity(value interface{}, path string) []Violation {
+	switch value := value.(type) {
+	case float64:
+		return nil
+	case string:
+		if quantity.MatchString(value) {
+			return nil
+		}
+		return []Violation{{Field: path, Message: fmt.Sprintf("invalid quantity %q", value)}}
+	default:
+		return []Violation{expected(path, "quantity", value)}
+	}
+}
+
+func expected(path, typ string, value interface{}) Violation {
+	actual := "null"
+	switch value.(type) {
+	case map[string]interface{}:
+		actual = "object"
+	case []interface{}:
+		actual = "array"
+	case string:
+		actual = "string"
+	case float64:
+		actual = "number"
+	case bool:
+		actual = "boolean"
+	}
+	return Violation{Field: path, Message: fmt.Sprintf("expected %s, got %s", typ, actual)}
+}
+
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,322 @@
+package values
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// CPI are the values of the rancher-vsphere-cpi chart.
+type CPI struct {
+	VCenter                     CPIVCenter                      `json:"vCenter"`
+	NodesEnable                 bool                            `json:"nodesEnable"`
+	Nodes                       CPINodes                        `json:"nodes"`
+	NSXT                        CPINSXT                         `json:"nsxt"`
+	LoadBalancer                CPILoadBalancer                 `json:"loadBalancer"`
+	LoadBalancerClass           map[string]CPILoadBalancerClass `json:"loadBalancerClass"`
+	Route                       CPIRoute                        `json:"route"`
+	AllowUnsupportedKubeVersion bool                            `json:"allowUnsupportedKubeVersion"`
+	VersionSkewFallback         bool                            `json:"versionSkewFallback"`
+	VersionOverrides            []VersionOverride[CPIOverrides] `json:"versionOverrides"`
+	CloudControllerManager      CloudControllerManager          `json:"cloudControllerManager"`
+	Tests                       Tests                           `json:"tests"`
+	Global                      CPIGlobal                       `json:"global"`
+}
+
+// CPIVCenter is the vCenter connection of the CPI chart.
+type CPIVCenter struct {
+	Host               string        `json:"host"`
+	Port               int           `json:"port"`
+	InsecureFlag       bool          `json:"insecureFlag"`
+	CAFile             string        `json:"caFile"`
+	Thumbprint         string        `json:"thumbprint"`
+	SoapRoundtripCount int           `json:"soapRoundtripCount"`
+	SecretsDirectory   string        `json:"secretsDirectory"`
+	IPFamily           []string      `json:"ipFamily"`
+	Datacenters        string        `json:"datacenters"`
+	Username           string        `json:"username"`
+	Password           string        `json:"password"`
+	CredentialsSecret  GeneratedName `json:"credentialsSecret"`
+	CloudConfig        GeneratedName `json:"cloudConfig"`
+	Labels             CPIZoneLabels `json:"labels"`
+}
+
+// GeneratedName names a resource that the chart generates unless generate is false.
+type GeneratedName struct {
+	Name     string `json:"name"`
+	Generate bool   `json:"generate"`
+}
+
+// CPIZoneLabels are the vSphere tag categories used for the region and zone of nodes.
+type CPIZoneLabels struct {
+	Region   string `json:"region"`
+	Zone     string `json:"zone"`
+	Generate bool   `json:"generate"`
+}
+
+// CPINodes are the node address selection filters.
+type CPINodes struct {
+	InternalNetworkSubnetCidr        string `json:"internalNetworkSubnetCidr"`
+	ExternalNetworkSubnetCidr        string `json:"externalNetworkSubnetCidr"`
+	InternalVMNetworkName            string `json:"internalVmNetworkName"`
+	ExternalVMNetworkName            string `json:"externalVmNetworkName"`
+	ExcludeInternalNetworkSubnetCidr string `json:"excludeInternalNetworkSubnetCidr"`
+	ExcludeExternalNetworkSubnetCidr string `json:"excludeExternalNetworkSubnetCidr"`
+}
+
+// CPILoadBalancerClass is an NSX-T load balancer class: the IP pool and application
+// profiles of the load balancers.
+type CPILoadBalancerClass struct {
+	IPPoolName        string `json:"ipPoolName,omitempty"`
+	IPPoolID          string `json:"ipPoolId,omitempty"`
+	TCPAppProfileName string `json:"tcpAppProfileName,omitempty"`
+	TCPAppProfilePath string `json:"tcpAppProfilePath,omitempty"`
+	UDPAppProfileName string `json:"udpAppProfileName,omitempty"`
+	UDPAppProfilePath string `json:"udpAppProfilePath,omitempty"`
+}
+
+// CPINSXT is the NSX-T manager used by the load balancer and the pod routing.
+type CPINSXT struct {
+	Host              string        `json:"host"`
+	InsecureFlag      bool          `json:"insecureFlag"`
+	RemoteAuth        bool          `json:"remoteAuth"`
+	CAFile            string        `json:"caFile"`
+	Username          string        `json:"username"`
+	Password          string        `json:"password"`
+	CredentialsSecret GeneratedName `json:"credentialsSecret"`
+}
+
+// CPILoadBalancer is the NSX-T load balancer. The fields other than Enabled are the
+// loadBalancer section of the cloud config, of which only those set are rendered.
+type CPILoadBalancer struct {
+	Enabled           bool              `json:"enabled"`
+	Size              string            `json:"size"`
+	LBServiceID       string            `json:"lbServiceId"`
+	Tier1GatewayPath  string            `json:"tier1GatewayPath"`
+	SnatDisabled      bool              `json:"snatDisabled"`
+	Tags              map[string]string `json:"tags"`
+	IPPoolName        string            `json:"ipPoolName"`
+	IPPoolID          string            `json:"ipPoolId"`
+	TCPAppProfileName string            `json:"tcpAppProfileName"`
+	TCPAppProfilePath string            `json:"tcpAppProfilePath"`
+	UDPAppProfileName string            `json:"udpAppProfileName"`
+	UDPAppProfilePath string            `json:"udpAppProfilePath"`
+}
+
+// CPIRoute is the NSX-T pod routing: the route section of the cloud config and the route
+// controller arguments of the cloud controller manager.
+type CPIRoute struct {
+	Enabled     bool   `json:"enabled"`
+	RouterPath  string `json:"routerPath"`
+	ClusterCidr string `json:"clusterCidr"`
+}
+
+// LoadBalancerSizes are the accepted values of loadBalancer.size.
+var LoadBalancerSizes = []string{"SMALL", "MEDIUM", "LARGE", "XLARGE", "DLB"}
+
+// CPILeaderElection is the leader election of the cloud controller manager. Empty
+// durations and resource name leave the upstream defaults.
+type CPILeaderElection struct {
+	Enabled       bool   `json:"enabled"`
+	LeaseDuration string `json:"leaseDuration"`
+	RenewDeadline string `json:"renewDeadline"`
+	RetryPeriod   string `json:"retryPeriod"`
+	ResourceName  string `json:"resourceName"`
+}
+
+// CPIKinds are the accepted values of cloudControllerManager.kind.
+var CPIKinds = []string{"DaemonSet", "Deployment"}
+
+// CPIPodDisruptionBudget is the PodDisruptionBudget of the cloud controller manager
+// Deployment.
+type CPIPodDisruptionBudget struct {
+	Enabled        bool               `json:"enabled"`
+	MaxUnavailable intstr.IntOrString `json:"maxUnavailable"`
+}
+
+// CloudControllerManager is the cloud controller manager DaemonSet or Deployment.
+type CloudControllerManager struct {
+	ImageRef
+	Kind                string                  `json:"kind"`
+	Replicas            int                     `json:"replicas"`
+	PodAntiAffinity     *v1.PodAntiAffinity     `json:"podAntiAffinity"`
+	PodDisruptionBudget CPIPodDisruptionBudget  `json:"podDisruptionBudget"`
+	ImagePullPolicy     v1.PullPolicy           `json:"imagePullPolicy"`
+	Verbosity           int                     `json:"verbosity"`
+	Controllers         []string                `json:"controllers"`
+	LeaderElection      CPILeaderElection       `json:"leaderElection"`
+	AdditionalArgs      []string                `json:"additionalArgs"`
+	Resources           v1.ResourceRequirements `json:"resources"`
+	NodeSelector        map[string]string       `json:"nodeSelector"`
+	Affinity            v1.Affinity             `json:"affinity"`
+	Tolerations         []v1.Toleration         `json:"tolerations"`
+	PodLabels           map[string]string       `json:"podLabels"`
+	RBAC                Feature                 `json:"rbac"`
+	Env                 []v1.EnvVar             `json:"env"`
+	DNSPolicy           v1.DNSPolicy            `json:"dnsPolicy"`
+	PriorityClassName   string                  `json:"priorityClassName"`
+}
+
+// CPIGlobal are the global values of the CPI chart.
+type CPIGlobal struct {
+	ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets"`
+	Cattle           Cattle                    `json:"cattle"`
+	Prime            Prime                     `json:"prime"`
+	Proxy            Proxy                     `json:"proxy"`
+	Distribution     string                    `json:"distribution"`
+	IPFamily         string                    `json:"ipFamily"`
+}
+
+// CPIOverrides are the values a CPI versionOverrides entry may set.
+type CPIOverrides struct {
+	CloudControllerManager *ImageOverride `json:"cloudControllerManager,omitempty"`
+}
+
+// LoadCPI strictly loads a CPI values file.
+func LoadCPI(path string) (*CPI, error) {
+	values := &CPI{}
+	if err := load(path, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// LoadCPIChart loads the default values of the CPI chart at chartPath.
+func LoadCPIChart(chartPath string) (*CPI, error) {
+	return LoadCPI(chartValuesFile(chartPath))
+}
+
+// DeepCopy returns a copy of the values that shares no memory with them.
+func (c *CPI) DeepCopy() (*CPI, error) {
+	out := &CPI{}
+	if err := deepCopy(out, c); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ApplyVersionOverrides fills in the values left unset from the versionOverrides matching
+// kubeVersion, or its previous minor, see VersionOverridesKubeVersion.
+func (c *CPI) ApplyVersionOverrides(kubeVersion string) error {
+	version, err := c.VersionOverridesKubeVersion(kubeVersion)
+	if err != nil {
+		return err
+	}
+	return fillVersionOverrides(c, c.VersionOverrides, version)
+}
+
+// VersionOverridesKubeVersion returns the Kubernetes version the versionOverrides are
+// matched against, like the versionOverridesKubeVersion helper of the chart: kubeVersion,
+// or its previous minor when versionSkewFallback is set and only that one is matched by
+// an entry, as the version skew policy of the cloud controller manager allows.
+func (c *CPI) VersionOverridesKubeVersion(kubeVersion string) (string, error) {
+	matched, err := hasVersionOverride(c.VersionOverrides, kubeVersion)
+	if err != nil || matched || !c.VersionSkewFallback {
+		return kubeVersion, err
+	}
+	version := semver.MustParse(kubeVersion)
+	if version.Minor() == 0 {
+		return kubeVersion, nil
+	}
+	previous := fmt.Sprintf("%d.%d.0", version.Major(), version.Minor()-1)
+	matched, err = hasVersionOverride(c.VersionOverrides, previous)
+	if err != nil || !matched {
+		return kubeVersion, err
+	}
+	return previous, nil
+}
+
+// Validate checks the values for settings the chart would reject or render incorrectly.
+func (c *CPI) Validate() error {
+	errs := []error{
+		validatePort("vCenter.port", c.VCenter.Port),
+		validateOneOf("global.distribution", c.Global.Distribution, Distributions),
+		validateProxy("global.proxy", c.Global.Proxy),
+		validateTests("tests", c.Tests),
+		validateVersionOverrides(c.VersionOverrides),
+	}
+	errs = append(errs, validatePullPolicy("cloudControllerManager.imagePullPolicy", c.CloudControllerManager.ImagePullPolicy))
+	errs = append(errs, validateOneOf("cloudControllerManager.kind", c.CloudControllerManager.Kind, CPIKinds))
+	if c.CloudControllerManager.Kind == "Deployment" {
+		if c.CloudControllerManager.Replicas < 1 {
+			errs = append(errs, fmt.Errorf("cloudControllerManager.replicas: must be at least 1, got %d", c.CloudControllerManager.Replicas))
+		}
+		if c.CloudControllerManager.Replicas > 1 && !c.CloudControllerManager.LeaderElection.Enabled {
+			errs = append(errs, errors.New("cloudControllerManager.leaderElection.enabled: must be true when the Deployment runs more than one replica"))
+		}
+	}
+	if c.CloudControllerManager.Verbosity < 0 {
+		errs = append(errs, fmt.Errorf("cloudControllerManager.verbosity: must not be negative, got %d", c.CloudControllerManager.Verbosity))
+	}
+	leaderElection := c.CloudControllerManager.LeaderElection
+	for _, field := range []struct{ name, value string }{
+		{"leaseDuration", leaderElection.LeaseDuration},
+		{"renewDeadline", leaderElection.RenewDeadline},
+		{"retryPeriod", leaderElection.RetryPeriod},
+	} {
+		if _, err := time.ParseDuration(field.value); field.value != "" && err != nil {
+			errs = append(errs, fmt.Errorf("cloudControllerManager.leaderElection.%s: %w", field.name, err))
+		}
+	}
+	if c.VCenter.SoapRoundtripCount < 0 {
+		errs = append(errs, fmt.Errorf("vCenter.soapRoundtripCount: must not be negative, got %d", c.VCenter.SoapRoundtripCount))
+	}
+	if c.LoadBalancer.Enabled {
+		errs = append(errs, validateOneOf("loadBalancer.size", c.LoadBalancer.Size, LoadBalancerSizes))
+	}
+	if c.Route.Enabled {
+		if c.Route.RouterPath == "" {
+			errs = append(errs, errors.New("route.routerPath: must be set when route.enabled is true"))
+		}
+		if c.Route.ClusterCidr == "" {
+			errs = append(errs, errors.New("route.clusterCidr: must be set when route.enabled is true"))
+		}
+		for _, cidr := range strings.Split(c.Route.ClusterCidr, ",") {
+			if _, _, err := net.ParseCIDR(cidr); cidr != "" && err != nil {
+				errs = append(errs, fmt.Errorf("route.clusterCidr: %w", err))
+			}
+		}
+	}
+	if c.LoadBalancer.Enabled || c.Route.Enabled {
+		if c.NSXT.Host == "" {
+			errs = append(errs, errors.New("nsxt.host: must be set when loadBalancer.enabled or route.enabled is true"))
+		}
+		if c.NSXT.CredentialsSecret.Generate && (c.NSXT.Username == "" || c.NSXT.Password == "") {
+			errs = append(errs, errors.New("nsxt.username and nsxt.password: must be set when nsxt.credentialsSecret.generate is true"))
+		}
+	}
+	for _, family := range c.VCenter.IPFamily {
+		if family != "ipv4" && family != "ipv6" {
+			errs = append(errs, fmt.Errorf("vCenter.ipFamily: must be a list of ipv4 and ipv6, got %q", family))
+		}
+	}
+	// The repository and tags are left empty for the versionOverrides to select them.
+	if c.CloudControllerManager.PrimeRepository == "" {
+		errs = append(errs, errors.New("cloudControllerManager.primeRepository: must be set"))
+	}
+	if c.Global.IPFamily != "" {
+		for _, family := range strings.Split(c.Global.IPFamily, ",") {
+			if family != "ipv4" && family != "ipv6" {
+				errs = append(errs, fmt.Errorf("global.ipFamily: must be a comma separated list of ipv4 and ipv6, got %q", c.Global.IPFamily))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// YAML encodes the values as a values file.
+func (c *CPI) YAML() ([]byte, error) {
+	return toYAML(c)
+}
+
+// WriteFile writes the values as a values file at path.
+func (c *CPI) WriteFile(path string) error {
+	return writeFile(path, c)
+}
@@ -0,0 +1,335 @@
+package values
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// CSI are the values of the rancher-vsphere-csi chart.
+type CSI struct {
+	VCenter                        CSIVCenter                      `json:"vCenter"`
+	CSIController                  CSIController                   `json:"csiController"`
+	CSIMigration                   CSIMigration                    `json:"csiMigration"`
+	CSIAuthCheck                   Feature                         `json:"csiAuthCheck"`
+	OnlineVolumeExtend             Feature                         `json:"onlineVolumeExtend"`
+	TriggerCSIFullsync             Feature                         `json:"triggerCsiFullsync"`
+	AsyncQueryVolume               Feature                         `json:"asyncQueryVolume"`
+	ImprovedCSIIdempotency         Feature                         `json:"improvedCsiIdempotency"`
+	ImprovedVolumeTopology         Feature                         `json:"improvedVolumeTopology"`
+	BlockVolumeSnapshot            Feature                         `json:"blockVolumeSnapshot"`
+	CSIWindowsSupport              Feature                         `json:"csiWindowsSupport"`
+	UseCSINodeID                   Feature                         `json:"useCsinodeId"`
+	ListVolumes                    VersionedFeature                `json:"listVolumes"`
+	PVToBackingDiskObjectIDMapping VersionedFeature                `json:"pvToBackingdiskobjectidMapping"`
+	CnsMgrSuspendCreateVolume      Feature                         `json:"cnsmgrSuspendCreateVolume"`
+	Topology                       Feature                         `json:"topology"`
+	TopologyPreferentialDatastores VersionedFeature                `json:"topologyPreferentialDatastores"`
+	MaxPvscsiTargetsPerVM          Feature                         `json:"maxPvscsiTargetsPerVm"`
+	MultiVCenterCSITopology        Feature                         `json:"multiVcenterCsiTopology"`
+	CSIInternalGeneratedClusterID  Feature                         `json:"csiInternalGeneratedClusterId"`
+	FeatureStates                  map[string]bool                 `json:"featureStates"`
+	CSINode                        CSINode                         `json:"csiNode"`
+	CSINodeWindows                 CSINodeWindows                  `json:"csiNodeWindows"`
+	CertManager                    CertManager                     `json:"certManager"`
+	StorageClass                   StorageClass                    `json:"storageClass"`
+	Tests                          Tests                           `json:"tests"`
+	Global                         CSIGlobal                       `json:"global"`
+	AllowUnsupportedKubeVersion    bool                            `json:"allowUnsupportedKubeVersion"`
+	VersionOverrides               []VersionOverride[CSIOverrides] `json:"versionOverrides"`
+}
+
+// CSIVCenter is the vCenter connection of the CSI chart.
+type CSIVCenter struct {
+	Host         string          `json:"host"`
+	Port         int             `json:"port"`
+	InsecureFlag string          `json:"insecureFlag"`
+	ClusterID    string          `json:"clusterId"`
+	Datacenters  string          `json:"datacenters"`
+	Username     string          `json:"username"`
+	Password     string          `json:"password"`
+	Labels       CSITopologyTags `json:"labels"`
+	ConfigSecret ConfigSecret    `json:"configSecret"`
+}
+
+// CSITopologyTags are the vSphere tag categories used for topology.
+type CSITopologyTags struct {
+	TopologyCategories string `json:"topologyCategories"`
+}
+
+// ConfigSecret is the Secret holding csi-vsphere.conf.
+type ConfigSecret struct {
+	Name           string `json:"name"`
+	Generate       bool   `json:"generate"`
+	ConfigTemplate string `json:"configTemplate"`
+}
+
+// CSIController is the CSI controller Deployment.
+type CSIController struct {
+	CSIResizer                VersionedFeature              `json:"csiResizer"`
+	Image                     CSIControllerImages           `json:"image"`
+	NodeSelector              map[string]string             `json:"nodeSelector"`
+	Affinity                  v1.Affinity                   `json:"affinity"`
+	Tolerations               []v1.Toleration               `json:"tolerations"`
+	PodLabels                 map[string]string             `json:"podLabels"`
+	DNSPolicy                 v1.DNSPolicy                  `json:"dnsPolicy"`
+	PriorityClassName         string                        `json:"priorityClassName"`
+	PodAntiAffinity           *v1.PodAntiAffinity           `json:"podAntiAffinity"`
+	TopologySpreadConstraints []v1.TopologySpreadConstraint `json:"topologySpreadConstraints"`
+	MetricsTLS                MetricsTLS                    `json:"metricsTLS"`
+}
+
+// CSIControllerImages are the driver image of the controller and its sidecars.
+type CSIControllerImages struct {
+	Image
+	CSIAttacher    Image `json:"csiAttacher"`
+	CSIResizer     Image `json:"csiResizer"`
+	LivenessProbe  Image `json:"livenessProbe"`
+	VsphereSyncer  Image `json:"vsphereSyncer"`
+	CSIProvisioner Image `json:"csiProvisioner"`
+	CSISnapshotter Image `json:"csiSnapshotter"`
+	VsphereWebhook Image `json:"vsphereWebhook"`
+	MetricsProxy   Image `json:"metricsProxy"`
+}
+
+// MetricsTLS serves the controller metrics over TLS through proxy sidecars.
+type MetricsTLS struct {
+	Enabled                 bool   `json:"enabled"`
+	MountPath               string `json:"mountPath"`
+	CertificateValidityDays int    `json:"certificateValidityDays"`
+}
+
+// CSIMigration is the migration of in-tree vSphere volumes and its validation webhook.
+type CSIMigration struct {
+	Enabled               bool       `json:"enabled"`
+	MigrationDatastoreURL string     `json:"migrationDatastoreURL"`
+	KeepCRD               bool       `json:"keepCRD"`
+	Webhook               CSIWebhook `json:"webhook"`
+}
+
+// CSIWebhook is the vSphere CSI validation webhook Deployment.
+type CSIWebhook struct {
+	Replicas                int               `json:"replicas"`
+	Port                    int               `json:"port"`
+	FailurePolicy           string            `json:"failurePolicy"`
+	CertificateValidityDays int               `json:"certificateValidityDays"`
+	PriorityClassName       string            `json:"priorityClassName"`
+	PodLabels               map[string]string `json:"podLabels"`
+}
+
+// CSINode is the Linux CSI node DaemonSet.
+type CSINode struct {
+	NodeSelector      map[string]string `json:"nodeSelector"`
+	Tolerations       []v1.Toleration   `json:"tolerations"`
+	PodLabels         map[string]string `json:"podLabels"`
+	PrefixPath        string            `json:"prefixPath"`
+	PrefixPathWindows string            `json:"prefixPathWindows"`
+	MaxVolumesPerNode string            `json:"maxVolumesPerNode"`
+	DNSPolicy         v1.DNSPolicy      `json:"dnsPolicy"`
+	PriorityClassName string            `json:"priorityClassName"`
+	Image             CSINodeImages     `json:"image"`
+}
+
+// CSINodeImages are the driver image of a node DaemonSet and its sidecars.
+type CSINodeImages struct {
+	Image
+	NodeDriverRegistrar Image `json:"nodeDriverRegistrar"`
+	LivenessProbe       Image `json:"livenessProbe"`
+}
+
+// CSINodeWindows is the Windows CSI node DaemonSet. Its image blocks are overlaid on the
+// csiNode ones, so empty repositories and tags fall back to those.
+type CSINodeWindows struct {
+	NodeSelector      map[string]string         `json:"nodeSelector"`
+	Affinity          v1.Affinity               `json:"affinity"`
+	Tolerations       []v1.Toleration           `json:"tolerations"`
+	PodLabels         map[string]string         `json:"podLabels"`
+	ImagePullSecrets  []v1.LocalObjectReference `json:"imagePullSecrets"`
+	PriorityClassName string                    `json:"priorityClassName"`
+	HostProcess       HostProcess               `json:"hostProcess"`
+	Image             CSINodeImages             `json:"image"`
+}
+
+// HostProcess runs the Windows node pods as HostProcess containers.
+type HostProcess struct {
+	Enabled       bool   `json:"enabled"`
+	RunAsUserName string `json:"runAsUserName"`
+}
+
+// CertManager is the cert-manager integration for the certificates of the chart.
+type CertManager struct {
+	Enabled   bool      `json:"enabled"`
+	IssuerRef IssuerRef `json:"issuerRef"`
+}
+
+// IssuerRef references an existing cert-manager Issuer or ClusterIssuer.
+type IssuerRef struct {
+	Name  string `json:"name,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// StorageClass is the default StorageClass of the chart.
+type StorageClass struct {
+	Enabled              bool                             `json:"enabled"`
+	AllowVolumeExpansion bool                             `json:"allowVolumeExpansion"`
+	Name                 string                           `json:"name"`
+	IsDefault            bool                             `json:"isDefault"`
+	StoragePolicyName    string                           `json:"storagePolicyName"`
+	DatastoreURL         string                           `json:"datastoreURL"`
+	ReclaimPolicy        v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy"`
+}
+
+// CSIGlobal are the global values of the CSI chart.
+type CSIGlobal struct {
+	ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets"`
+	Proxy            Proxy                     `json:"proxy"`
+	Distribution     string                    `json:"distribution"`
+	Cattle           Cattle                    `json:"cattle"`
+	Prime            Prime                     `json:"prime"`
+}
+
+// CSIOverrides are the values a CSI versionOverrides entry may set. They only fill in the
+// values left unset, see ApplyVersionOverrides.
+type CSIOverrides struct {
+	CSIController                  *CSIControllerOverrides `json:"csiController,omitempty"`
+	CSINode                        *CSINodeOverrides       `json:"csiNode,omitempty"`
+	CSIMigration                   *FeatureOverride        `json:"csiMigration,omitempty"`
+	CSIAuthCheck                   *FeatureOverride        `json:"csiAuthCheck,omitempty"`
+	OnlineVolumeExtend             *FeatureOverride        `json:"onlineVolumeExtend,omitempty"`
+	TriggerCSIFullsync             *FeatureOverride        `json:"triggerCsiFullsync,omitempty"`
+	AsyncQueryVolume               *FeatureOverride        `json:"asyncQueryVolume,omitempty"`
+	ImprovedCSIIdempotency         *FeatureOverride        `json:"improvedCsiIdempotency,omitempty"`
+	ImprovedVolumeTopology         *FeatureOverride        `json:"improvedVolumeTopology,omitempty"`
+	BlockVolumeSnapshot            *FeatureOverride        `json:"blockVolumeSnapshot,omitempty"`
+	CSIWindowsSupport              *FeatureOverride        `json:"csiWindowsSupport,omitempty"`
+	UseCSINodeID                   *FeatureOverride        `json:"useCsinodeId,omitempty"`
+	ListVolumes                    *FeatureOverride        `json:"listVolumes,omitempty"`
+	PVToBackingDiskObjectIDMapping *FeatureOverride        `json:"pvToBackingdiskobjectidMapping,omitempty"`
+	CnsMgrSuspendCreateVolume      *FeatureOverride        `json:"cnsmgrSuspendCreateVolume,omitempty"`
+	Topology                       *FeatureOverride        `json:"topology,omitempty"`
+	TopologyPreferentialDatastores *FeatureOverride        `json:"topologyPreferentialDatastores,omitempty"`
+	MaxPvscsiTargetsPerVM          *FeatureOverride        `json:"maxPvscsiTargetsPerVm,omitempty"`
+	MultiVCenterCSITopology        *FeatureOverride        `json:"multiVcenterCsiTopology,omitempty"`
+	CSIInternalGeneratedClusterID  *FeatureOverride        `json:"csiInternalGeneratedClusterId,omitempty"`
+	FeatureStates                  map[string]bool         `json:"featureStates,omitempty"`
+}
+
+// CSIControllerOverrides are the csiController values a versionOverrides entry may set.
+type CSIControllerOverrides struct {
+	CSIResizer *FeatureOverride             `json:"csiResizer,omitempty"`
+	Image      *CSIControllerImageOverrides `json:"image,omitempty"`
+}
+
+// CSIControllerImageOverrides are the csiController.image values a versionOverrides entry may set.
+type CSIControllerImageOverrides struct {
+	ImageOverride
+	CSIAttacher    *ImageOverride `json:"csiAttacher,omitempty"`
+	CSIResizer     *ImageOverride `json:"csiResizer,omitempty"`
+	LivenessProbe  *ImageOverride `json:"livenessProbe,omitempty"`
+	VsphereSyncer  *ImageOverride `json:"vsphereSyncer,omitempty"`
+	CSIProvisioner *ImageOverride `json:"csiProvisioner,omitempty"`
+	CSISnapshotter *ImageOverride `json:"csiSnapshotter,omitempty"`
+	VsphereWebhook *ImageOverride `json:"vsphereWebhook,omitempty"`
+}
+
+// CSINodeOverrides are the csiNode values a versionOverrides entry may set.
+type CSINodeOverrides struct {
+	Image *CSINodeImageOverrides `json:"image,omitempty"`
+}
+
+// CSINodeImageOverrides are the csiNode.image values a versionOverrides entry may set.
+type CSINodeImageOverrides struct {
+	ImageOverride
+	NodeDriverRegistrar *ImageOverride `json:"nodeDriverRegistrar,omitempty"`
+	LivenessProbe       *ImageOverride `json:"livenessProbe,omitempty"`
+}
+
+// LoadCSI strictly loads a CSI values file.
+func LoadCSI(path string) (*CSI, error) {
+	values := &CSI{}
+	if err := load(path, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// LoadCSIChart loads the default values of the CSI chart at chartPath.
+func LoadCSIChart(chartPath string) (*CSI, error) {
+	return LoadCSI(chartValuesFile(chartPath))
+}
+
+// DeepCopy returns a copy of the values that shares no memory with them.
+func (c *CSI) DeepCopy() (*CSI, error) {
+	out := &CSI{}
+	if err := deepCopy(out, c); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ApplyVersionOverrides sets the values left unset, such as the empty image tags and the
+// null VersionedFeature toggles, to those of the versionOverrides matching kubeVersion.
+// Values already set are kept.
+func (c *CSI) ApplyVersionOverrides(kubeVersion string) error {
+	return fillVersionOverrides(c, c.VersionOverrides, kubeVersion)
+}
+
+// Images returns every image block of the chart keyed by its values path.
+func (c *CSI) Images() map[string]Image {
+	return map[string]Image{
+		"csiController.image":                c.CSIController.Image.Image,
+		"csiController.image.csiAttacher":    c.CSIController.Image.CSIAttacher,
+		"csiController.image.csiResizer":     c.CSIController.Image.CSIResizer,
+		"csiController.image.livenessProbe":  c.CSIController.Image.LivenessProbe,
+		"csiController.image.vsphereSyncer":  c.CSIController.Image.VsphereSyncer,
+		"csiController.image.csiProvisioner": c.CSIController.Image.CSIProvisioner,
+		"csiController.image.csiSnapshotter": c.CSIController.Image.CSISnapshotter,
+		"csiController.image.vsphereWebhook": c.CSIController.Image.VsphereWebhook,
+		"csiController.image.metricsProxy":   c.CSIController.Image.MetricsProxy,
+		"csiNode.image":                      c.CSINode.Image.Image,
+		"csiNode.image.nodeDriverRegistrar":  c.CSINode.Image.NodeDriverRegistrar,
+		"csiNode.image.livenessProbe":        c.CSINode.Image.LivenessProbe,
+	}
+}
+
+// Validate checks the values for settings the chart would reject or render incorrectly.
+func (c *CSI) Validate() error {
+	errs := []error{
+		validatePort("vCenter.port", c.VCenter.Port),
+		validatePort("csiMigration.webhook.port", c.CSIMigration.Webhook.Port),
+		validateOneOf("csiMigration.webhook.failurePolicy", c.CSIMigration.Webhook.FailurePolicy, []string{"Fail", "Ignore"}),
+		validateOneOf("storageClass.reclaimPolicy", string(c.StorageClass.ReclaimPolicy), []string{"Delete", "Retain"}),
+		validateOneOf("global.distribution", c.Global.Distribution, Distributions),
+		validateProxy("global.proxy", c.Global.Proxy),
+		validateTests("tests", c.Tests),
+		validateVersionOverrides(c.VersionOverrides),
+	}
+	images := c.Images()
+	for _, path := range slices.Sorted(maps.Keys(images)) {
+		errs = append(errs, validateImage(path, images[path], false))
+	}
+	errs = append(errs,
+		validateImage("csiNodeWindows.image", c.CSINodeWindows.Image.Image, true),
+		validateImage("csiNodeWindows.image.nodeDriverRegistrar", c.CSINodeWindows.Image.NodeDriverRegistrar, true),
+		validateImage("csiNodeWindows.image.livenessProbe", c.CSINodeWindows.Image.LivenessProbe, true),
+	)
+	if _, err := strconv.Atoi(c.CSINode.MaxVolumesPerNode); err != nil {
+		errs = append(errs, fmt.Errorf("csiNode.maxVolumesPerNode: must be a number, got %q", c.CSINode.MaxVolumesPerNode))
+	}
+	return errors.Join(errs...)
+}
+
+// YAML encodes the values as a values file.
+func (c *CSI) YAML() ([]byte, error) {
+	return toYAML(c)
+}
+
+// WriteFile writes the values as a values file at path.
+func (c *CSI) WriteFile(path string) error {
+	return writeFile(path, c)
+}
@@ -0,0 +1,76 @@
+package values
+
+// Reference returns the image reference rendered by the vsphere.image and
+// system_default_registry helpers. The Prime repository and tag are used when prime is
+// set and the image has a Prime repository. An empty tag renders as latest like the
+// charts do.
+func (i ImageRef) Reference(prime bool, registry string) string {
+	repository, tag := i.Repository, i.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	if prime && i.PrimeRepository != "" {
+		repository = i.PrimeRepository
+		if i.PrimeTag != "" {
+			tag = i.PrimeTag
+		}
+	}
+	if registry != "" {
+		repository = registry + "/" + repository
+	}
+	return repository + ":" + tag
+}
+
+// WindowsImage returns the image block rendered by the windows.image helper: the
+// repositories and tags of linux, overlaid with the non-empty fields of windows.
+func WindowsImage(linux, windows Image) Image {
+	image := windows
+	image.ImageRef = linux.ImageRef
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&image.Repository, windows.Repository},
+		{&image.PrimeRepository, windows.PrimeRepository},
+		{&image.Tag, windows.Tag},
+		{&image.PrimeTag, windows.PrimeTag},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+	return image
+}
+
+// ImageReferences returns the reference of every image of the chart keyed by its values
+// path.
+func (c *CPI) ImageReferences() map[string]string {
+	references := map[string]string{
+		"cloudControllerManager": c.CloudControllerManager.Reference(c.Global.Prime.Enabled, c.Global.Cattle.SystemDefaultRegistry),
+	}
+	if c.Tests.Enabled {
+		references["tests.image"] = c.Tests.Image.Reference(c.Global.Prime.Enabled, c.Global.Cattle.SystemDefaultRegistry)
+	}
+	return references
+}
+
+// ImageReferences returns the reference of every image of the chart keyed by its values
+// path, including the csiNodeWindows images resolved against the csiNode ones.
+func (c *CSI) ImageReferences() map[string]string {
+	prime, registry := c.Global.Prime.Enabled, c.Global.Cattle.SystemDefaultRegistry
+	references := map[string]string{}
+	for path, image := range c.Images() {
+		references[path] = image.Reference(prime, registry)
+	}
+	for path, image := range map[string]Image{
+		"csiNodeWindows.image":                     WindowsImage(c.CSINode.Image.Image, c.CSINodeWindows.Image.Image),
+		"csiNodeWindows.image.nodeDriverRegistrar": WindowsImage(c.CSINode.Image.NodeDriverRegistrar, c.CSINodeWindows.Image.NodeDriverRegistrar),
+		"csiNodeWindows.image.livenessProbe":       WindowsImage(c.CSINode.Image.LivenessProbe, c.CSINodeWindows.Image.LivenessProbe),
+	} {
+		references[path] = image.Reference(prime, registry)
+	}
+	if c.Tests.Enabled {
+		references["tests.image"] = c.Tests.Image.Reference(prime, registry)
+	}
+	return references
+}
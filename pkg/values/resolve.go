@@ -0,0 +1,140 @@
+package values
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"sigs.k8s.io/yaml"
+)
+
+// Chart names of the charts modelled by this package.
+const (
+	CPIChartName = "rancher-vsphere-cpi"
+	CSIChartName = "rancher-vsphere-csi"
+)
+
+// ResolveOptions select the chart and the cluster to resolve values for.
+type ResolveOptions struct {
+	// ChartPath is the directory of the chart.
+	ChartPath string
+	// KubeVersion is the Kubernetes version of the cluster, as in --kube-version.
+	KubeVersion string
+	// Prime sets global.prime.enabled.
+	Prime bool
+	// Registry sets global.cattle.systemDefaultRegistry.
+	Registry string
+	// AllowUnsupportedKubeVersion sets allowUnsupportedKubeVersion.
+	AllowUnsupportedKubeVersion bool
+}
+
+// Resolution are the effective values of a chart and the image references they render.
+type Resolution struct {
+	Chart       string            `json:"chart"`
+	KubeVersion string            `json:"kubeVersion"`
+	Images      map[string]string `json:"images"`
+	Values      interface{}       `json:"values"`
+	// Warnings are those of the release notes, such as a version skew fallback.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Resolve loads the default values of a chart and applies the versionOverrides matching
+// the Kubernetes version, the same way the applyVersionOverrides helper does. Unless
+// allowed, an unsupported Kubernetes version fails like the kubeVersionGuard helper.
+func Resolve(opts ResolveOptions) (*Resolution, error) {
+	chart, err := loadChartMetadata(opts.ChartPath)
+	if err != nil {
+		return nil, err
+	}
+	name := chart.Name
+	supported := chart.Annotations["catalog.cattle.io/kube-version"]
+	resolution := &Resolution{Chart: name, KubeVersion: opts.KubeVersion}
+	switch name {
+	case CPIChartName:
+		v, err := LoadCPIChart(opts.ChartPath)
+		if err != nil {
+			return nil, err
+		}
+		v.Global.Prime.Enabled = opts.Prime
+		v.Global.Cattle.SystemDefaultRegistry = opts.Registry
+		v.AllowUnsupportedKubeVersion = opts.AllowUnsupportedKubeVersion
+		overridesVersion, err := v.VersionOverridesKubeVersion(opts.KubeVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !v.AllowUnsupportedKubeVersion {
+			if err := checkKubeVersion(name+" "+chart.Version, supported, v.VersionOverrides, opts.KubeVersion, overridesVersion); err != nil {
+				return nil, err
+			}
+		}
+		if err := v.ApplyVersionOverrides(opts.KubeVersion); err != nil {
+			return nil, err
+		}
+		if overridesVersion != opts.KubeVersion {
+			warning := fmt.Sprintf("%s %s has no CPI release for Kubernetes %s, so the CPI release of Kubernetes %s is used", name, chart.Version, opts.KubeVersion, strings.TrimSuffix(overridesVersion, ".0"))
+			if !supportsKubeVersion(supported, opts.KubeVersion) {
+				warning += fmt.Sprintf(", although Kubernetes %s is outside the Kubernetes versions %s of the chart", opts.KubeVersion, supported)
+			}
+			resolution.Warnings = append(resolution.Warnings, warning)
+		}
+		resolution.Values, resolution.Images = v, v.ImageReferences()
+	case CSIChartName:
+		v, err := LoadCSIChart(opts.ChartPath)
+		if err != nil {
+			return nil, err
+		}
+		v.Global.Prime.Enabled = opts.Prime
+		v.Global.Cattle.SystemDefaultRegistry = opts.Registry
+		v.AllowUnsupportedKubeVersion = opts.AllowUnsupportedKubeVersion
+		if !v.AllowUnsupportedKubeVersion {
+			if err := checkKubeVersion(name+" "+chart.Version, supported, v.VersionOverrides, opts.KubeVersion, opts.KubeVersion); err != nil {
+				return nil, err
+			}
+		}
+		if err := v.ApplyVersionOverrides(opts.KubeVersion); err != nil {
+			return nil, err
+		}
+		resolution.Values, resolution.Images = v, v.ImageReferences()
+	default:
+		return nil, fmt.Errorf("%s: unsupported chart %q", opts.ChartPath, name)
+	}
+	return resolution, nil
+}
+
+// YAML encodes the resolution.
+func (r *Resolution) YAML() ([]byte, error) {
+	return toYAML(r)
+}
+
+// chartMetadata are the fields of a Chart.yaml read by Resolve.
+type chartMetadata struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// loadChartMetadata reads the Chart.yaml of the chart at chartPath.
+func loadChartMetadata(chartPath string) (*chartMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	chart := &chartMetadata{}
+	if err := yaml.Unmarshal(data, chart); err != nil {
+		return nil, fmt.Errorf("%s: %w", chartPath, err)
+	}
+	return chart, nil
+}
+
+// supportsKubeVersion reports whether kubeVersion is within the supported constraint, the
+// catalog.cattle.io/kube-version annotation of a chart.
+func supportsKubeVersion(supported, kubeVersion string) bool {
+	constraint, err := semver.NewConstraint(supported)
+	if err != nil {
+		return false
+	}
+	version, err := semver.NewVersion(kubeVersion)
+	return err == nil && constraint.Check(version)
+}
@@ -0,0 +1,377 @@
+// Package values is a typed model of the values.yaml files of the rancher-vsphere-cpi and
+// rancher-vsphere-csi charts.
+//
+// Values files are decoded strictly, so a key that is not part of the model is an error,
+// and can be written back to YAML to be passed to Helm. ApplyVersionOverrides resolves the
+// versionOverrides the same way as the applyVersionOverrides helper of the charts.
+package values
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// ValuesFile is the name of the default values file of a chart.
+const ValuesFile = "values.yaml"
+
+// Distributions are the accepted values of global.distribution.
+var Distributions = []string{"", "rke1", "rke2", "k3s", "generic"}
+
+// ImageRef is the location of an image in the public and Prime registries.
+type ImageRef struct {
+	Repository      string `json:"repository"`
+	PrimeRepository string `json:"primeRepository"`
+	Tag             string `json:"tag"`
+	PrimeTag        string `json:"primeTag"`
+}
+
+// Image is an image block of the CSI chart, such as csiController.image.csiAttacher.
+type Image struct {
+	ImageRef
+	ImagePullPolicy v1.PullPolicy           `json:"imagePullPolicy"`
+	AdditionalArgs  []string                `json:"additionalArgs"`
+	Resources       v1.ResourceRequirements `json:"resources"`
+}
+
+// ImageOverride is the part of an image block that versionOverrides may fill in. Empty
+// fields are left out so they do not fill in the values left unset.
+type ImageOverride struct {
+	Repository      string `json:"repository,omitempty"`
+	PrimeRepository string `json:"primeRepository,omitempty"`
+	Tag             string `json:"tag,omitempty"`
+	PrimeTag        string `json:"primeTag,omitempty"`
+}
+
+// VersionOverride is an entry of versionOverrides: values merged over the defaults when
+// the Kubernetes version matches the semver constraint.
+type VersionOverride[T any] struct {
+	Constraint string `json:"constraint"`
+	Values     T      `json:"values"`
+}
+
+// Feature is a values block that only toggles a feature.
+type Feature struct {
+	Enabled bool `json:"enabled"`
+}
+
+// VersionedFeature is a Feature block that, left null, takes the state set by the
+// versionOverrides matching the Kubernetes version.
+type VersionedFeature struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// FeatureOverride is a Feature block that versionOverrides may set.
+type FeatureOverride struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// Cattle holds the global values set by Rancher.
+type Cattle struct {
+	SystemDefaultRegistry string `json:"systemDefaultRegistry"`
+	ClusterID             string `json:"clusterId,omitempty"`
+}
+
+// Prime selects the Prime repositories and tags of every image.
+type Prime struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Proxy is the HTTP(S) proxy of the containers reaching vCenter. NoProxy is extended by
+// the charts with the loopback and cluster domain names, the service CIDR and the API
+// server addresses.
+type Proxy struct {
+	HTTPProxy   string `json:"httpProxy"`
+	HTTPSProxy  string `json:"httpsProxy"`
+	NoProxy     string `json:"noProxy"`
+	ServiceCidr string `json:"serviceCidr"`
+}
+
+// Tests is the helm test pod checking the vCenter connection with the config of a chart.
+type Tests struct {
+	Enabled   bool                    `json:"enabled"`
+	Image     TestsImage              `json:"image"`
+	Resources v1.ResourceRequirements `json:"resources"`
+}
+
+// TestsImage is the image of the test pod, which has no Prime repository.
+type TestsImage struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+}
+
+// Reference returns the image reference rendered by the vsphere.image and
+// system_default_registry helpers.
+func (i TestsImage) Reference(prime bool, registry string) string {
+	return ImageRef{Repository: i.Repository, Tag: i.Tag}.Reference(prime, registry)
+}
+
+// validateTests checks that the image of the test pod is set when it is enabled.
+func validateTests(path string, tests Tests) error {
+	if tests.Enabled && tests.Image.Repository == "" {
+		return fmt.Errorf("%s.image.repository: must be set when %s.enabled is true", path, path)
+	}
+	return nil
+}
+
+// load strictly decodes the values file at path into v.
+func load(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// chartValuesFile returns the path of the default values file of the chart at chartPath.
+func chartValuesFile(chartPath string) string {
+	return filepath.Join(chartPath, ValuesFile)
+}
+
+// toYAML encodes v as YAML.
+func toYAML(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+// writeFile encodes v as YAML into the file at path.
+func writeFile(path string, v interface{}) error {
+	data, err := toYAML(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// deepCopy copies src into dst through its JSON encoding.
+func deepCopy(dst, src interface{}) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// fillVersionOverrides sets the values of dst left unset, missing, null or an empty
+// string, to those of the overrides whose constraint matches kubeVersion, later overrides
+// taking precedence, like the applyVersionOverrides helper of the charts. Values set in
+// dst always win.
+func fillVersionOverrides[T any](dst interface{}, overrides []VersionOverride[T], kubeVersion string) error {
+	version, err := semver.NewVersion(kubeVersion)
+	if err != nil {
+		return fmt.Errorf("invalid Kubernetes version %q: %w", kubeVersion, err)
+	}
+	merged := map[string]interface{}{}
+	for _, override := range overrides {
+		constraint, err := semver.NewConstraint(override.Constraint)
+		if err != nil {
+			return fmt.Errorf("versionOverrides: invalid constraint %q: %w", override.Constraint, err)
+		}
+		if !constraint.Check(version) {
+			continue
+		}
+		var values map[string]interface{}
+		if err := deepCopy(&values, override.Values); err != nil {
+			return fmt.Errorf("versionOverrides: %s: %w", override.Constraint, err)
+		}
+		mergeOverwrite(merged, values)
+	}
+	var current map[string]interface{}
+	if err := deepCopy(&current, dst); err != nil {
+		return err
+	}
+	fillUnset(current, merged)
+	return deepCopy(dst, current)
+}
+
+// checkKubeVersion fails like the kubeVersionGuard helper of the charts when kubeVersion
+// is outside the supported constraint, the catalog.cattle.io/kube-version annotation of
+// chart, or when no override matches overridesVersion, the version the overrides are
+// matched against, see hasVersionOverride. A kubeVersion outside the constraint passes
+// when overridesVersion differs from it and is within the constraint, as when the
+// versionSkewFallback of the CPI chart selects the entries of the previous minor.
+func checkKubeVersion[T any](chart, supported string, overrides []VersionOverride[T], kubeVersion, overridesVersion string) error {
+	version, err := semver.NewVersion(kubeVersion)
+	if err != nil {
+		return fmt.Errorf("invalid Kubernetes version %q: %w", kubeVersion, err)
+	}
+	constraint, err := semver.NewConstraint(supported)
+	if err != nil {
+		return fmt.Errorf("%s: invalid supported Kubernetes versions %q: %w", chart, supported, err)
+	}
+	skewed := false
+	if overridesVersion != kubeVersion {
+		previous, err := semver.NewVersion(overridesVersion)
+		if err != nil {
+			return fmt.Errorf("invalid Kubernetes version %q: %w", overridesVersion, err)
+		}
+		skewed = constraint.Check(previous)
+	}
+	if !constraint.Check(version) && !skewed {
+		return fmt.Errorf("Kubernetes %s is not supported by %s, which requires Kubernetes %s, set allowUnsupportedKubeVersion to install it anyway", kubeVersion, chart, supported)
+	}
+	matched, err := hasVersionOverride(overrides, overridesVersion)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return fmt.Errorf("no versionOverrides entry of %s matches Kubernetes %s, set allowUnsupportedKubeVersion to install it anyway", chart, kubeVersion)
+	}
+	return nil
+}
+
+// hasVersionOverride reports whether an override matches kubeVersion, like the
+// hasVersionOverride helper of the charts. Overrides matching every version, such as the
+// catch-all ">= 0.0.0-0" of the CPI chart, do not count.
+func hasVersionOverride[T any](overrides []VersionOverride[T], kubeVersion string) (bool, error) {
+	version, err := semver.NewVersion(kubeVersion)
+	if err != nil {
+		return false, fmt.Errorf("invalid Kubernetes version %q: %w", kubeVersion, err)
+	}
+	zero := semver.MustParse("0.0.0-0")
+	for _, override := range overrides {
+		constraint, err := semver.NewConstraint(override.Constraint)
+		if err != nil {
+			return false, fmt.Errorf("versionOverrides: invalid constraint %q: %w", override.Constraint, err)
+		}
+		if constraint.Check(version) && !constraint.Check(zero) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mergeOverwrite sets the values of dst to those of src, recursing into the maps of both.
+func mergeOverwrite(dst, src map[string]interface{}) {
+	for key, value := range src {
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		srcMap, srcIsMap := value.(map[string]interface{})
+		if dstIsMap && srcIsMap {
+			mergeOverwrite(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// fillUnset sets the values of dst that are missing, null or an empty string to those of
+// src, recursing into the maps of both.
+func fillUnset(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch current := dst[key].(type) {
+		case map[string]interface{}:
+			if srcMap, ok := value.(map[string]interface{}); ok {
+				fillUnset(current, srcMap)
+			}
+		case nil:
+			dst[key] = value
+		case string:
+			if current == "" {
+				dst[key] = value
+			}
+		}
+	}
+}
+
+// validateVersionOverrides checks that every constraint of overrides parses.
+func validateVersionOverrides[T any](overrides []VersionOverride[T]) error {
+	var errs []error
+	for i, override := range overrides {
+		if _, err := semver.NewConstraint(override.Constraint); err != nil {
+			errs = append(errs, fmt.Errorf("versionOverrides[%d].constraint: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateImage checks an image block named by path. Overlay image blocks, such as the
+// csiNodeWindows ones, may leave the repository and tag empty.
+func validateImage(path string, image Image, overlay bool) error {
+	var errs []error
+	if !overlay {
+		errs = append(errs, validateImageRef(path, image.ImageRef))
+	}
+	errs = append(errs, validatePullPolicy(path+".imagePullPolicy", image.ImagePullPolicy))
+	return errors.Join(errs...)
+}
+
+// validatePullPolicy checks that policy is empty or a valid image pull policy.
+func validatePullPolicy(path string, policy v1.PullPolicy) error {
+	switch policy {
+	case "", v1.PullAlways, v1.PullIfNotPresent, v1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("%s: must be one of Always, IfNotPresent or Never, got %q", path, policy)
+}
+
+// validateImageRef checks that the repositories of an image are set. The tag may be
+// empty, versionOverrides then set it or latest is used. The primeTag may be empty, the
+// Prime image then uses the tag.
+func validateImageRef(path string, image ImageRef) error {
+	var errs []error
+	for _, field := range []struct{ name, value string }{
+		{"repository", image.Repository},
+		{"primeRepository", image.PrimeRepository},
+	} {
+		if field.value == "" {
+			errs = append(errs, fmt.Errorf("%s.%s: must be set", path, field.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateOneOf checks that value is one of allowed.
+func validateOneOf(path, value string, allowed []string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: must be one of %s, got %q", path, strings.Join(allowed, ", "), value)
+}
+
+// validateProxy checks that the proxies are URLs and the service CIDR a comma separated
+// list of CIDRs.
+func validateProxy(path string, proxy Proxy) error {
+	var errs []error
+	for _, field := range []struct{ name, value string }{
+		{"httpProxy", proxy.HTTPProxy},
+		{"httpsProxy", proxy.HTTPSProxy},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if u, err := url.Parse(field.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: %w", path, field.name, err))
+		} else if u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.%s: must be a URL such as http://proxy.example.com:3128, got %q", path, field.name, field.value))
+		}
+	}
+	if proxy.ServiceCidr != "" {
+		for _, cidr := range strings.Split(proxy.ServiceCidr, ",") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs = append(errs, fmt.Errorf("%s.serviceCidr: %w", path, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validatePort checks that port is a valid TCP port.
+func validatePort(path string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s: must be between 1 and 65535, got %d", path, port)
+	}
+	return nil
+}
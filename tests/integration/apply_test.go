@@ -0,0 +1,298 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	fieldManager = "vsphere-charts-integration"
+	// cpiNamespace is where the CPI is installed, as its RoleBinding references the
+	// extension-apiserver-authentication-reader Role that only exists in kube-system.
+	cpiNamespace = "kube-system"
+)
+
+func TestApplyRenderedCharts(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		// namespace is the release namespace, a new namespace when empty
+		namespace string
+		values    map[string]string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI",
+			args: args{
+				chartRelPath: cpiChart,
+				namespace:    cpiNamespace,
+				values:       map[string]string{},
+			},
+		},
+		{
+			name: "CPI with nodes and dual-stack",
+			args: args{
+				chartRelPath: cpiChart,
+				namespace:    cpiNamespace,
+				values: map[string]string{
+					"nodesEnable":             "true",
+					"vCenter.labels.generate": "true",
+					"global.ipFamily":         "ipv4,ipv6",
+				},
+			},
+		},
+		{
+			name: "CSI",
+			args: args{
+				chartRelPath: csiChart,
+				values:       map[string]string{"vCenter.clusterId": random.UniqueId()},
+			},
+		},
+		{
+			name: "CSI with all features",
+			args: args{
+				chartRelPath: csiChart,
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.csiResizer.enabled": "true",
+					"blockVolumeSnapshot.enabled":      "true",
+					"csiWindowsSupport.enabled":        "true",
+					"csiMigration.enabled":             "true",
+					"csiController.metricsTLS.enabled": "true",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			ctx := context.Background()
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+			namespace := tt.args.namespace
+			if namespace == "" {
+				namespace = "inttest-" + strings.ToLower(random.UniqueId())
+				require.NoError(t, k8sClient.Create(ctx, &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}))
+			}
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+			output := helm.RenderTemplate(t, options, chartPath, "inttest", nil, "--kube-version", kubeVersion)
+			objects := decode(t, output)
+
+			// act
+			for _, object := range objects {
+				apply(ctx, t, namespace, object)
+			}
+			t.Cleanup(func() {
+				// cluster scoped objects such as the CSIDriver are shared by the cases
+				for _, object := range slices.Backward(objects) {
+					if err := k8sClient.Delete(ctx, object); err != nil && !apierrors.IsNotFound(err) {
+						t.Errorf("deleting %s %s: %v", object.GetKind(), object.GetName(), err)
+					}
+				}
+			})
+
+			// assert
+			requireBindingReferences(ctx, t, objects)
+			requireAccepted(ctx, t, objects)
+		})
+	}
+}
+
+// decode returns the objects of the output of helm template, in install order.
+func decode(t *testing.T, output string) []*unstructured.Unstructured {
+	var objects []*unstructured.Unstructured
+	for _, manifest := range strings.Split(output, "\n---\n") {
+		object := &unstructured.Unstructured{}
+		require.NoError(t, yaml.Unmarshal([]byte(manifest), &object.Object))
+		if len(object.Object) == 0 {
+			continue
+		}
+		objects = append(objects, object)
+	}
+	require.NotEmpty(t, objects)
+	return objects
+}
+
+// apply server-side applies an object, defaulting the namespace of namespaced objects
+// the way helm install does.
+func apply(ctx context.Context, t *testing.T, namespace string, object *unstructured.Unstructured) {
+	namespaced, err := k8sClient.IsObjectNamespaced(object)
+	require.NoError(t, err, "%s %s", object.GetKind(), object.GetName())
+	if namespaced && object.GetNamespace() == "" {
+		object.SetNamespace(namespace)
+	}
+	err = k8sClient.Patch(ctx, object, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	require.NoError(t, err, "applying %s %s", object.GetKind(), object.GetName())
+}
+
+// requireBindingReferences checks that the roles and service accounts referenced by the
+// rendered RoleBindings and ClusterRoleBindings exist.
+func requireBindingReferences(ctx context.Context, t *testing.T, objects []*unstructured.Unstructured) {
+	for _, object := range objects {
+		var roleRef rbacv1.RoleRef
+		var subjects []rbacv1.Subject
+		switch object.GetKind() {
+		case "RoleBinding":
+			var binding rbacv1.RoleBinding
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &binding))
+			roleRef, subjects = binding.RoleRef, binding.Subjects
+		case "ClusterRoleBinding":
+			var binding rbacv1.ClusterRoleBinding
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &binding))
+			roleRef, subjects = binding.RoleRef, binding.Subjects
+		default:
+			continue
+		}
+
+		var role client.Object = &rbacv1.ClusterRole{}
+		key := client.ObjectKey{Name: roleRef.Name}
+		if roleRef.Kind == "Role" {
+			role, key.Namespace = &rbacv1.Role{}, object.GetNamespace()
+		}
+		require.NoError(t, k8sClient.Get(ctx, key, role), "%s %s references %s %s", object.GetKind(), object.GetName(), roleRef.Kind, roleRef.Name)
+
+		for _, subject := range subjects {
+			if subject.Kind != rbacv1.ServiceAccountKind {
+				continue
+			}
+			serviceAccount := &v1.ServiceAccount{}
+			key := client.ObjectKey{Namespace: subject.Namespace, Name: subject.Name}
+			require.NoError(t, k8sClient.Get(ctx, key, serviceAccount), "%s %s binds ServiceAccount %s/%s", object.GetKind(), object.GetName(), subject.Namespace, subject.Name)
+		}
+	}
+}
+
+// requireAccepted checks that the rendered CSIDriver and StorageClass objects were
+// stored as rendered, without fields dropped by the API server.
+func requireAccepted(ctx context.Context, t *testing.T, objects []*unstructured.Unstructured) {
+	for _, object := range objects {
+		switch object.GetKind() {
+		case "CSIDriver":
+			var rendered, stored storagev1.CSIDriver
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &rendered))
+			require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(object), &stored))
+			require.Equal(t, rendered.Spec.AttachRequired, stored.Spec.AttachRequired)
+			require.Equal(t, rendered.Spec.PodInfoOnMount, stored.Spec.PodInfoOnMount)
+			if rendered.Spec.VolumeLifecycleModes != nil {
+				require.Equal(t, rendered.Spec.VolumeLifecycleModes, stored.Spec.VolumeLifecycleModes)
+			}
+		case "StorageClass":
+			var rendered, stored storagev1.StorageClass
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(object.Object, &rendered))
+			require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(object), &stored))
+			require.Equal(t, "csi.vsphere.vmware.com", stored.Provisioner)
+			require.Equal(t, rendered.Parameters, stored.Parameters)
+			require.Equal(t, rendered.AllowVolumeExpansion, stored.AllowVolumeExpansion)
+			require.Equal(t, rendered.Annotations, stored.Annotations)
+		}
+	}
+}
+
+// TestApplyCnsVSphereVolumeMigration checks that the rendered cnsvspherevolumemigrations
+// CRD accepts the objects the syncer writes for migrated in-tree volumes, without pruning
+// their fields.
+func TestApplyCnsVSphereVolumeMigration(t *testing.T) {
+	type args struct {
+		spec map[string]interface{}
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Protected volume",
+			args: args{
+				spec: map[string]interface{}{
+					"volumepath":                "[datastore1] kubevols/kubernetes-dynamic-pvc-1.vmdk",
+					"volumeid":                  "4f4c9e2e-2a6b-4d1b-9f44-6a1f0d0e6c11",
+					"protectvolumefromvmdelete": true,
+				},
+			},
+		},
+		{
+			name: "Unprotected volume",
+			args: args{
+				spec: map[string]interface{}{
+					"volumepath": "[datastore1] kubevols/kubernetes-dynamic-pvc-2.vmdk",
+					"volumeid":   "9b0d7c55-3e2f-4a87-b1c6-2d8e5f7a9c22",
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	chartPath, err := filepath.Abs(csiChart)
+	require.NoError(t, err)
+	options := &helm.Options{
+		SetValues: map[string]string{
+			"vCenter.clusterId":    random.UniqueId(),
+			"csiMigration.enabled": "true",
+		},
+	}
+	output := helm.RenderTemplate(t, options, chartPath, "inttest", []string{"templates/webhook/crd.yaml"}, "--kube-version", kubeVersion)
+	crd := decode(t, output)[0]
+	apply(ctx, t, "", crd)
+	t.Cleanup(func() {
+		if err := k8sClient.Delete(ctx, crd); err != nil && !apierrors.IsNotFound(err) {
+			t.Errorf("deleting CustomResourceDefinition %s: %v", crd.GetName(), err)
+		}
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			// the syncer names the objects after the CNS volume ID
+			migration := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "cns.vmware.com/v1alpha1",
+				"kind":       "CnsVSphereVolumeMigration",
+				"metadata":   map[string]interface{}{"name": tt.args.spec["volumeid"]},
+				"spec":       tt.args.spec,
+			}}
+
+			// act
+			// the CRD is served once it is established
+			require.EventuallyWithT(t, func(c *assert.CollectT) {
+				err := k8sClient.Patch(ctx, migration.DeepCopy(), client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+				assert.NoError(c, err)
+			}, 30*time.Second, 250*time.Millisecond)
+			t.Cleanup(func() {
+				if err := k8sClient.Delete(ctx, migration); err != nil && !apierrors.IsNotFound(err) {
+					t.Errorf("deleting CnsVSphereVolumeMigration %s: %v", migration.GetName(), err)
+				}
+			})
+
+			// assert
+			stored := &unstructured.Unstructured{}
+			stored.SetGroupVersionKind(migration.GroupVersionKind())
+			require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(migration), stored))
+			require.Equal(t, tt.args.spec, stored.Object["spec"])
+		})
+	}
+}
@@ -0,0 +1,69 @@
+//go:build integration
+
+// Package integration applies the rendered charts to a local kube-apiserver and etcd
+// started by envtest. The binaries are found through KUBEBUILDER_ASSETS, see the
+// integration-tests target of the Makefile; no network access is needed once they are
+// downloaded.
+package integration
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+const (
+	cpiChart = "../../charts/rancher-vsphere-cpi"
+	csiChart = "../../charts/rancher-vsphere-csi"
+)
+
+var (
+	// k8sClient talks to the envtest API server.
+	k8sClient client.Client
+	// kubeVersion is the version of the envtest API server, passed to helm template.
+	kubeVersion string
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		fmt.Fprintln(os.Stderr, "KUBEBUILDER_ASSETS must be the directory of the envtest binaries, run make integration-tests")
+		return 1
+	}
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "starting envtest:", err)
+		return 1
+	}
+	defer func() {
+		if err := env.Stop(); err != nil {
+			fmt.Fprintln(os.Stderr, "stopping envtest:", err)
+		}
+	}()
+
+	k8sClient, err = client.New(cfg, client.Options{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "creating client:", err)
+		return 1
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "creating discovery client:", err)
+		return 1
+	}
+	version, err := discoveryClient.ServerVersion()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reading server version:", err)
+		return 1
+	}
+	kubeVersion = version.GitVersion
+	return m.Run()
+}
@@ -1,28 +1,44 @@
 package unit
 
 import (
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/helm"
 	"github.com/gruntwork-io/terratest/modules/k8s"
 	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/values"
 	"github.com/stretchr/testify/require"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	lbconfig "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphere/loadbalancer/config"
 )
 
 const cpiChart = "../../charts/rancher-vsphere-cpi"
 
 func TestCPITemplateRenderedDaemonset(t *testing.T) {
 	type args struct {
-		values        map[string]string
-		kubeVersion   string
-		namespace     string
-		releaseName   string
-		chartRelPath  string
-		expectedImage string
+		values                   map[string]string
+		kubeVersion              string
+		namespace                string
+		releaseName              string
+		chartRelPath             string
+		expectedImage            string
+		expectedImagePullPolicy  v1.PullPolicy
+		expectedImagePullSecrets []v1.LocalObjectReference
+		expectedArgs             []string
+		expectedResources        v1.ResourceRequirements
+	}
+	defaultArgs := []string{"--cloud-provider=vsphere", "--v=2", "--cloud-config=/etc/cloud/vsphere.yaml"}
+	defaultResources := v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("200m")},
 	}
 	tests := []struct {
 		name string
@@ -31,12 +47,14 @@ func TestCPITemplateRenderedDaemonset(t *testing.T) {
 		{
 			name: "Kubernetes 1.36",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.36",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				values:            map[string]string{},
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
@@ -45,11 +63,13 @@ func TestCPITemplateRenderedDaemonset(t *testing.T) {
 				values: map[string]string{
 					"global.prime.enabled": "true",
 				},
-				kubeVersion:   "1.36",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/hardened-cloud-provider-vsphere:v1.36.0-build20260722",
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/hardened-cloud-provider-vsphere:v1.36.0-build20260722",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
@@ -59,110 +79,257 @@ func TestCPITemplateRenderedDaemonset(t *testing.T) {
 					"global.prime.enabled":                "true",
 					"global.cattle.systemDefaultRegistry": "registry.rancher.com",
 				},
-				kubeVersion:   "1.36",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "registry.rancher.com/rancher/hardened-cloud-provider-vsphere:v1.36.0-build20260722",
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "registry.rancher.com/rancher/hardened-cloud-provider-vsphere:v1.36.0-build20260722",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Kubernetes 1.32 Prime",
+			args: args{
+				values: map[string]string{
+					"global.prime.enabled": "true",
+				},
+				kubeVersion:       "1.32",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/hardened-cloud-provider-vsphere:latest",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.35",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.35",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.35.1",
+				values:            map[string]string{},
+				kubeVersion:       "1.35",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.35.1",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.34",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.34",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.34.0",
+				values:            map[string]string{},
+				kubeVersion:       "1.34",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.34.0",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.33",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.33",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.33.1",
+				values:            map[string]string{},
+				kubeVersion:       "1.33",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.33.1",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.32",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.32",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.32.2",
+				values:            map[string]string{},
+				kubeVersion:       "1.32",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.32.2",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.31",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.31",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.31.1",
+				values:            map[string]string{},
+				kubeVersion:       "1.31",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.31.1",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.30",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.30",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.30.1",
+				values:            map[string]string{},
+				kubeVersion:       "1.30",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.30.1",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.29",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.29",
-				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.29.0",
+				values:            map[string]string{},
+				kubeVersion:       "1.29",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.29.0",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
 			},
 		},
 		{
 			name: "Kubernetes 1.28",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.28",
+				values:            map[string]string{},
+				kubeVersion:       "1.28",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.28.0",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Kubernetes 1.27",
+			args: args{
+				values:            map[string]string{},
+				kubeVersion:       "1.27",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.27.0",
+				expectedArgs:      defaultArgs,
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Additional args",
+			args: args{
+				values:            map[string]string{"cloudControllerManager.additionalArgs[0]": "--kube-api-qps=50"},
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:      append(slices.Clone(defaultArgs), "--kube-api-qps=50"),
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Verbosity",
+			args: args{
+				values:            map[string]string{"cloudControllerManager.verbosity": "4"},
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:      []string{"--cloud-provider=vsphere", "--v=4", "--cloud-config=/etc/cloud/vsphere.yaml"},
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Controllers",
+			args: args{
+				values:            map[string]string{"cloudControllerManager.controllers": "{*,-route}"},
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:      append(slices.Clone(defaultArgs), "--controllers=*,-route"),
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Leader election lease settings",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.leaderElection.leaseDuration": "30s",
+					"cloudControllerManager.leaderElection.renewDeadline": "20s",
+					"cloudControllerManager.leaderElection.retryPeriod":   "4s",
+					"cloudControllerManager.leaderElection.resourceName":  "vsphere-cloud-controller-manager",
+				},
+				kubeVersion:   "1.36",
 				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
 				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
 				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.28.0",
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs: append(slices.Clone(defaultArgs),
+					"--leader-elect-lease-duration=30s",
+					"--leader-elect-renew-deadline=20s",
+					"--leader-elect-retry-period=4s",
+					"--leader-elect-resource-name=vsphere-cloud-controller-manager",
+				),
+				expectedResources: defaultResources,
 			},
 		},
 		{
-			name: "Kubernetes 1.27",
+			name: "Leader election disabled",
+			args: args{
+				values:            map[string]string{"cloudControllerManager.leaderElection.enabled": "false"},
+				kubeVersion:       "1.36",
+				namespace:         "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      cpiChart,
+				expectedImage:     "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:      append(slices.Clone(defaultArgs), "--leader-elect=false"),
+				expectedResources: defaultResources,
+			},
+		},
+		{
+			name: "Image pull policy and secrets",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.imagePullPolicy": "Always",
+					"global.imagePullSecrets[0].name":        "registry-creds",
+				},
+				kubeVersion:              "1.36",
+				namespace:                "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:              "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:             cpiChart,
+				expectedImage:            "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedImagePullPolicy:  v1.PullAlways,
+				expectedImagePullSecrets: []v1.LocalObjectReference{{Name: "registry-creds"}},
+				expectedArgs:             defaultArgs,
+				expectedResources:        defaultResources,
+			},
+		},
+		{
+			name: "Resources",
 			args: args{
-				values:        map[string]string{},
-				kubeVersion:   "1.27",
+				values: map[string]string{
+					"cloudControllerManager.resources.requests.cpu":  "100m",
+					"cloudControllerManager.resources.limits.memory": "256Mi",
+				},
+				kubeVersion:   "1.36",
 				namespace:     "cpitest-" + strings.ToLower(random.UniqueId()),
 				releaseName:   "cpitest-" + strings.ToLower(random.UniqueId()),
 				chartRelPath:  cpiChart,
-				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:v1.27.0",
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedArgs:  defaultArgs,
+				expectedResources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m")},
+					Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("256Mi")},
+				},
 			},
 		},
 	}
@@ -178,7 +345,7 @@ func TestCPITemplateRenderedDaemonset(t *testing.T) {
 			}
 
 			// act
-			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/daemonset.yaml"}, "--kube-version", tt.args.kubeVersion)
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", tt.args.kubeVersion)
 
 			var daemonSet appsv1.DaemonSet
 			helm.UnmarshalK8SYaml(t, output, &daemonSet)
@@ -188,51 +355,1363 @@ func TestCPITemplateRenderedDaemonset(t *testing.T) {
 			daemonSetContainers := daemonSet.Spec.Template.Spec.Containers
 			require.Equal(t, 1, len(daemonSetContainers))
 			require.Equal(t, tt.args.expectedImage, daemonSetContainers[0].Image)
+			require.Equal(t, tt.args.expectedImagePullPolicy, daemonSetContainers[0].ImagePullPolicy)
+			require.Equal(t, tt.args.expectedImagePullSecrets, daemonSet.Spec.Template.Spec.ImagePullSecrets)
+			require.Equal(t, tt.args.expectedArgs, daemonSetContainers[0].Args)
+			require.True(t, equality.Semantic.DeepEqual(tt.args.expectedResources, daemonSetContainers[0].Resources), "resources: %v", daemonSetContainers[0].Resources)
 		})
 	}
 }
 
 func TestCPITemplateRenderedSecret(t *testing.T) {
-	// arrange
-	chartPath, err := filepath.Abs(cpiChart)
-	require.NoError(t, err)
+	type args struct {
+		password string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{name: "Plain password", args: args{password: "test"}},
+		{name: "Password with quotes", args: args{password: `pa"ss'word`}},
+		{name: "Password with backslashes", args: args{password: `pass\word\`}},
+		{name: "Password with comment characters", args: args{password: "pass;word#"}},
+		{name: "Unicode password", args: args{password: "pässwörd\u00a0密码"}},
+		{name: "Password with control characters", args: args{password: "pass\tword\a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
 
-	namespace := "cpitest-" + strings.ToLower(random.UniqueId())
-	releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
-	options := &helm.Options{
-		SetValues:      map[string]string{"vCenter.host": "test", "vCenter.username": "test", "vCenter.password": "test"},
-		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+			releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				ValuesFiles: []string{cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Username = "administrator@vsphere.local"
+					v.VCenter.Password = tt.args.password
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/secret.yaml"}, "--kube-version", "1.36")
+
+			var secret v1.Secret
+			helm.UnmarshalK8SYaml(t, output, &secret)
+
+			// assert
+			require.Equal(t, namespace, secret.Namespace)
+			require.Equal(t, map[string][]byte{
+				"vcenter.example.com.username": []byte("administrator@vsphere.local"),
+				"vcenter.example.com.password": []byte(tt.args.password),
+			}, secret.Data)
+		})
 	}
+}
 
-	// act
-	output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/secret.yaml"}, "--kube-version", "1.23")
+func TestCPITemplateRenderedConfig(t *testing.T) {
+	type args struct {
+		values               func(*values.CPI)
+		expectedDatacenters  []string
+		expectedPort         uint
+		expectedInsecureFlag bool
+		expectedIPFamily     []string
+		expectedSecretName   string
+		expectedLabelsRegion string
+		expectedLabelsZone   string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default values",
+			args: args{
+				values:               func(*values.CPI) {},
+				expectedDatacenters:  []string{"DC0"},
+				expectedPort:         443,
+				expectedInsecureFlag: true,
+				expectedIPFamily:     []string{"ipv4"},
+				expectedSecretName:   "vsphere-cpi-creds",
+			},
+		},
+		{
+			name: "Several datacenters and dual-stack",
+			args: args{
+				values: func(v *values.CPI) {
+					v.VCenter.Datacenters = "DC0,DC1"
+					v.VCenter.Port = 8443
+					v.VCenter.InsecureFlag = false
+					v.Global.IPFamily = "ipv4,ipv6"
+				},
+				expectedDatacenters:  []string{"DC0,DC1"},
+				expectedPort:         8443,
+				expectedInsecureFlag: false,
+				expectedIPFamily:     []string{"ipv4", "ipv6"},
+				expectedSecretName:   "vsphere-cpi-creds",
+			},
+		},
+		{
+			name: "Names with quotes comment characters and unicode",
+			args: args{
+				values: func(v *values.CPI) {
+					v.VCenter.Datacenters = `Datacenter "A" #1; Zürich`
+					v.VCenter.CredentialsSecret.Name = "vsphere-creds"
+					v.VCenter.Labels.Generate = true
+					v.VCenter.Labels.Region = "k8s-région"
+					v.VCenter.Labels.Zone = `zone\a`
+				},
+				expectedDatacenters:  []string{`Datacenter "A" #1; Zürich`},
+				expectedPort:         443,
+				expectedInsecureFlag: true,
+				expectedIPFamily:     []string{"ipv4"},
+				expectedSecretName:   "vsphere-creds",
+				expectedLabelsRegion: "k8s-région",
+				expectedLabelsZone:   `zone\a`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+			releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				ValuesFiles: []string{cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Datacenters = "DC0"
+					tt.args.values(v)
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
 
-	var secret v1.Secret
-	helm.UnmarshalK8SYaml(t, output, &secret)
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/configmap.yaml"}, "--kube-version", "1.36")
+			cfg := cpiConfig(t, output)
 
-	// assert
-	require.Equal(t, namespace, secret.Namespace)
-	require.NotEmpty(t, secret.Data)
-	require.Contains(t, secret.Data, "test.username")
-	require.Contains(t, secret.Data, "test.password")
+			// assert
+			require.Equal(t, tt.args.expectedSecretName, cfg.Global.SecretName)
+			require.Equal(t, namespace, cfg.Global.SecretNamespace)
+			require.Equal(t, tt.args.expectedPort, cfg.Global.VCenterPort)
+			require.Equal(t, tt.args.expectedInsecureFlag, cfg.Global.InsecureFlag)
+			require.Equal(t, tt.args.expectedIPFamily, cfg.Global.IPFamilyPriority)
+			require.Len(t, cfg.Vcenter, 1)
+			require.Contains(t, cfg.Vcenter, "vcenter.example.com")
+			require.Equal(t, "vcenter.example.com", cfg.Vcenter["vcenter.example.com"].VCenterIP)
+			require.Equal(t, tt.args.expectedDatacenters, cfg.Vcenter["vcenter.example.com"].Datacenters)
+			require.Equal(t, tt.args.expectedLabelsRegion, cfg.Labels.Region)
+			require.Equal(t, tt.args.expectedLabelsZone, cfg.Labels.Zone)
+		})
+	}
 }
 
-func TestCPITemplateRenderedServiceAccount(t *testing.T) {
-	// arrange
-	chartPath, err := filepath.Abs(cpiChart)
-	require.NoError(t, err)
+func TestCPITemplateRenderedConfigRoundTrip(t *testing.T) {
+	type args struct {
+		values                     func(*values.CPI)
+		expectedCAFile             string
+		expectedThumbprint         string
+		expectedSoapRoundtripCount uint
+		expectedSecretName         string
+		expectedSecretsDirectory   string
+		expectedVCenterIPFamily    []string
+		expectedLoadBalancer       lbconfig.LoadBalancerConfigYAML
+		expectedLoadBalancerClass  map[string]*lbconfig.LoadBalancerClassConfigYAML
+		expectedRouterPath         string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default values",
+			args: args{
+				values:             func(*values.CPI) {},
+				expectedSecretName: "vsphere-cpi-creds",
+			},
+		},
+		{
+			name: "vCenter certificate and retries",
+			args: args{
+				values: func(v *values.CPI) {
+					v.VCenter.CAFile = "/etc/cloud/ca.pem"
+					v.VCenter.Thumbprint = "AA:BB:CC"
+					v.VCenter.SoapRoundtripCount = 3
+					v.VCenter.SecretsDirectory = "/etc/cloud/credentials"
+					v.VCenter.IPFamily = []string{"ipv6", "ipv4"}
+				},
+				expectedCAFile:             "/etc/cloud/ca.pem",
+				expectedThumbprint:         "AA:BB:CC",
+				expectedSoapRoundtripCount: 3,
+				expectedSecretName:         "",
+				expectedSecretsDirectory:   "/etc/cloud/credentials",
+				expectedVCenterIPFamily:    []string{"ipv6", "ipv4"},
+			},
+		},
+		{
+			name: "NSX-T load balancer and routes",
+			args: args{
+				values: func(v *values.CPI) {
+					v.NSXT.Host = "nsxt.example.com"
+					v.NSXT.Username = "admin"
+					v.NSXT.Password = "secret"
+					v.LoadBalancer.Enabled = true
+					v.LoadBalancer.Size = "MEDIUM"
+					v.LoadBalancer.Tier1GatewayPath = "/infra/tier-1s/t1"
+					v.LoadBalancer.SnatDisabled = true
+					v.LoadBalancer.Tags = map[string]string{"owner": "rancher"}
+					v.LoadBalancer.TCPAppProfileName = "default-tcp-lb-app-profile"
+					v.LoadBalancer.UDPAppProfileName = "default-udp-lb-app-profile"
+					v.LoadBalancerClass = map[string]values.CPILoadBalancerClass{
+						"default":  {IPPoolName: "lb-pool"},
+						"internal": {IPPoolID: "internal-pool-id"},
+					}
+					v.Route.Enabled = true
+					v.Route.RouterPath = "/infra/tier-1s/t1"
+					v.Route.ClusterCidr = "10.42.0.0/16"
+				},
+				expectedLoadBalancer: lbconfig.LoadBalancerConfigYAML{
+					Size:              "MEDIUM",
+					Tier1GatewayPath:  "/infra/tier-1s/t1",
+					SnatDisabled:      true,
+					AdditionalTags:    map[string]string{"owner": "rancher"},
+					TCPAppProfileName: "default-tcp-lb-app-profile",
+					UDPAppProfileName: "default-udp-lb-app-profile",
+				},
+				expectedLoadBalancerClass: map[string]*lbconfig.LoadBalancerClassConfigYAML{
+					"default":  {IPPoolName: "lb-pool"},
+					"internal": {IPPoolID: "internal-pool-id"},
+				},
+				expectedSecretName: "vsphere-cpi-creds",
+				expectedRouterPath: "/infra/tier-1s/t1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
 
-	namespace := "cpitest-" + strings.ToLower(random.UniqueId())
-	releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
-	options := &helm.Options{
-		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			options := &helm.Options{
+				ValuesFiles: []string{cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Datacenters = "DC0"
+					tt.args.values(v)
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", []string{"templates/configmap.yaml"}, "--kube-version", "1.36")
+			cfg := cpiCloudConfigRoundTrip(t, output)
+
+			// assert
+			require.Equal(t, tt.args.expectedCAFile, cfg.Global.CAFile)
+			require.Equal(t, tt.args.expectedThumbprint, cfg.Global.Thumbprint)
+			require.Equal(t, tt.args.expectedSoapRoundtripCount, cfg.Global.RoundTripperCount)
+			require.Equal(t, tt.args.expectedSecretName, cfg.Global.SecretName)
+			require.Equal(t, tt.args.expectedSecretsDirectory, cfg.Global.SecretsDirectory)
+			require.Contains(t, cfg.Vcenter, "vcenter.example.com")
+			require.Equal(t, tt.args.expectedVCenterIPFamily, cfg.Vcenter["vcenter.example.com"].IPFamilyPriority)
+			require.Equal(t, tt.args.expectedLoadBalancer, cfg.LoadBalancer)
+			require.Equal(t, tt.args.expectedLoadBalancerClass, cfg.LoadBalancerClass)
+			require.Equal(t, tt.args.expectedRouterPath, cfg.Route.RouterPath)
+		})
 	}
+}
 
-	// act
-	output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/service-account.yaml"}, "--kube-version", "1.23")
-	var sa v1.ServiceAccount
-	helm.UnmarshalK8SYaml(t, output, &sa)
+func TestCPITemplateRenderedLoadBalancer(t *testing.T) {
+	type args struct {
+		values                 func(*values.CPI)
+		expectedNSXTHost       string
+		expectedNSXTSecretName string
+		// expectedSecretData is nil when the chart does not generate the NSX-T Secret
+		expectedSecretData     map[string][]byte
+		expectedServicesStatus bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Disabled",
+			args: args{
+				values:                 func(*values.CPI) {},
+				expectedNSXTHost:       "",
+				expectedNSXTSecretName: "",
+				expectedSecretData:     nil,
+				expectedServicesStatus: false,
+			},
+		},
+		{
+			name: "Inline credentials",
+			args: args{
+				values: func(v *values.CPI) {
+					v.LoadBalancer.Enabled = true
+					v.NSXT.Host = "nsxt.example.com"
+					v.NSXT.Username = "admin"
+					v.NSXT.Password = `pa"ss:word`
+				},
+				expectedNSXTHost:       "nsxt.example.com",
+				expectedNSXTSecretName: "vsphere-cpi-nsxt-creds",
+				expectedSecretData:     map[string][]byte{"username": []byte("admin"), "password": []byte(`pa"ss:word`)},
+				expectedServicesStatus: true,
+			},
+		},
+		{
+			name: "Referenced credentials",
+			args: args{
+				values: func(v *values.CPI) {
+					v.LoadBalancer.Enabled = true
+					v.NSXT.Host = "nsxt.example.com"
+					v.NSXT.CredentialsSecret = values.GeneratedName{Name: "nsxt-creds", Generate: false}
+				},
+				expectedNSXTHost:       "nsxt.example.com",
+				expectedNSXTSecretName: "nsxt-creds",
+				expectedSecretData:     nil,
+				expectedServicesStatus: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
 
-	// assert
-	require.Equal(t, namespace, sa.Namespace)
+			namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				ValuesFiles: []string{cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Datacenters = "DC0"
+					v.LoadBalancer.Tier1GatewayPath = "/infra/tier-1s/t1"
+					v.LoadBalancer.IPPoolName = "lb-pool"
+					v.LoadBalancer.TCPAppProfileName = "default-tcp-lb-app-profile"
+					v.LoadBalancer.UDPAppProfileName = "default-udp-lb-app-profile"
+					tt.args.values(v)
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", nil, "--kube-version", "1.36")
+
+			// assert
+			var cfg *cpiCloudConfig
+			var secretData map[string][]byte
+			var servicesStatus bool
+			for _, manifest := range splitManifests(output) {
+				switch manifestSource(manifest) {
+				case "rancher-vsphere-cpi/templates/configmap.yaml":
+					cfg = cpiCloudConfigRoundTrip(t, manifest)
+				case "rancher-vsphere-cpi/templates/nsxt-secret.yaml":
+					var secret v1.Secret
+					helm.UnmarshalK8SYaml(t, manifest, &secret)
+					secretData = secret.Data
+				case "rancher-vsphere-cpi/templates/role.yaml":
+					var role rbacv1.ClusterRole
+					helm.UnmarshalK8SYaml(t, manifest, &role)
+					for _, rule := range role.Rules {
+						servicesStatus = servicesStatus || slices.Contains(rule.Resources, "services/status")
+					}
+				}
+			}
+			require.NotNil(t, cfg)
+			require.Equal(t, tt.args.expectedNSXTHost, cfg.NSXT.Host)
+			require.Equal(t, tt.args.expectedNSXTSecretName, cfg.NSXT.SecretName)
+			if tt.args.expectedNSXTSecretName != "" {
+				require.Equal(t, namespace, cfg.NSXT.SecretNamespace)
+				require.Equal(t, "/infra/tier-1s/t1", cfg.LoadBalancer.Tier1GatewayPath)
+			}
+			require.Empty(t, cfg.NSXT.User)
+			require.Empty(t, cfg.NSXT.Password)
+			require.Equal(t, tt.args.expectedSecretData, secretData)
+			require.Equal(t, tt.args.expectedServicesStatus, servicesStatus)
+		})
+	}
+}
+
+func TestCPITemplateRenderedRoutes(t *testing.T) {
+	type args struct {
+		values             func(*values.CPI)
+		expectedArgs       []string
+		expectedRouterPath string
+		expectedNSXTHost   string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Disabled",
+			args: args{
+				values:             func(*values.CPI) {},
+				expectedArgs:       []string{"--cloud-provider=vsphere", "--v=2", "--cloud-config=/etc/cloud/vsphere.yaml"},
+				expectedRouterPath: "",
+				expectedNSXTHost:   "",
+			},
+		},
+		{
+			name: "Enabled",
+			args: args{
+				values: func(v *values.CPI) {
+					v.Route.Enabled = true
+					v.Route.RouterPath = "/infra/tier-1s/t1"
+					v.Route.ClusterCidr = "10.42.0.0/16"
+				},
+				expectedArgs: []string{
+					"--cloud-provider=vsphere", "--v=2", "--cloud-config=/etc/cloud/vsphere.yaml",
+					"--configure-cloud-routes=true", "--allocate-node-cidrs=true", "--cluster-cidr=10.42.0.0/16",
+				},
+				expectedRouterPath: "/infra/tier-1s/t1",
+				expectedNSXTHost:   "nsxt.example.com",
+			},
+		},
+		{
+			name: "Dual-stack with the load balancer",
+			args: args{
+				values: func(v *values.CPI) {
+					v.Route.Enabled = true
+					v.Route.RouterPath = "/infra/tier-1s/t1"
+					v.Route.ClusterCidr = "10.42.0.0/16,fd00:42::/56"
+					v.LoadBalancer.Enabled = true
+					v.LoadBalancer.Tier1GatewayPath = "/infra/tier-1s/t1"
+					v.LoadBalancer.IPPoolName = "lb-pool"
+					v.LoadBalancer.TCPAppProfileName = "default-tcp-lb-app-profile"
+					v.LoadBalancer.UDPAppProfileName = "default-udp-lb-app-profile"
+				},
+				expectedArgs: []string{
+					"--cloud-provider=vsphere", "--v=2", "--cloud-config=/etc/cloud/vsphere.yaml",
+					"--configure-cloud-routes=true", "--allocate-node-cidrs=true", "--cluster-cidr=10.42.0.0/16,fd00:42::/56",
+				},
+				expectedRouterPath: "/infra/tier-1s/t1",
+				expectedNSXTHost:   "nsxt.example.com",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				ValuesFiles: []string{cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Datacenters = "DC0"
+					v.NSXT.Host = "nsxt.example.com"
+					v.NSXT.Username = "admin"
+					v.NSXT.Password = "secret"
+					tt.args.values(v)
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", []string{"templates/cloud-controller-manager.yaml", "templates/configmap.yaml"}, "--kube-version", "1.36")
+
+			// assert
+			var daemonSet appsv1.DaemonSet
+			var cfg *cpiCloudConfig
+			for _, manifest := range splitManifests(output) {
+				switch manifestSource(manifest) {
+				case "rancher-vsphere-cpi/templates/cloud-controller-manager.yaml":
+					helm.UnmarshalK8SYaml(t, manifest, &daemonSet)
+				case "rancher-vsphere-cpi/templates/configmap.yaml":
+					cfg = cpiCloudConfigRoundTrip(t, manifest)
+				}
+			}
+			require.Len(t, daemonSet.Spec.Template.Spec.Containers, 1)
+			require.Equal(t, tt.args.expectedArgs, daemonSet.Spec.Template.Spec.Containers[0].Args)
+			require.NotNil(t, cfg)
+			require.Equal(t, tt.args.expectedRouterPath, cfg.Route.RouterPath)
+			require.Equal(t, tt.args.expectedNSXTHost, cfg.NSXT.Host)
+		})
+	}
+}
+
+func TestCPITemplateRenderedServiceAccount(t *testing.T) {
+	// arrange
+	chartPath, err := filepath.Abs(cpiChart)
+	require.NoError(t, err)
+
+	namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+	releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
+	options := &helm.Options{
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+	}
+
+	// act
+	output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/service-account.yaml"}, "--kube-version", "1.36")
+	var sa v1.ServiceAccount
+	helm.UnmarshalK8SYaml(t, output, &sa)
+
+	// assert
+	require.Equal(t, namespace, sa.Namespace)
+}
+
+func TestCPITemplateRenderedDaemonsetPriorityClass(t *testing.T) {
+	type args struct {
+		values                    func(*values.CPI)
+		kubeVersion               string
+		namespace                 string
+		releaseName               string
+		chartRelPath              string
+		expectedPriorityClassName string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default priority class",
+			args: args{
+				values:                    func(*values.CPI) {},
+				kubeVersion:               "1.36",
+				namespace:                 "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              cpiChart,
+				expectedPriorityClassName: "system-cluster-critical",
+			},
+		},
+		{
+			name: "Custom priority class",
+			args: args{
+				values: func(v *values.CPI) {
+					v.CloudControllerManager.PriorityClassName = "infra-critical"
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              cpiChart,
+				expectedPriorityClassName: "infra-critical",
+			},
+		},
+		{
+			name: "Priority class disabled",
+			args: args{
+				values: func(v *values.CPI) {
+					v.CloudControllerManager.PriorityClassName = ""
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              cpiChart,
+				expectedPriorityClassName: "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				ValuesFiles:    []string{cpiValuesFile(t, chartPath, tt.args.values)},
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+
+			// assert
+			require.Equal(t, tt.args.expectedPriorityClassName, daemonSet.Spec.Template.Spec.PriorityClassName)
+			require.NotContains(t, daemonSet.Annotations, "scheduler.alpha.kubernetes.io/critical-pod")
+		})
+	}
+}
+
+func TestCPITemplateRenderedDaemonsetDistribution(t *testing.T) {
+	type args struct {
+		values                 map[string]string
+		kubeVersion            string
+		namespace              string
+		releaseName            string
+		chartRelPath           string
+		expectedNodeSelector   map[string]string
+		expectedTerms          [][]string
+		expectedTolerationKeys []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default",
+			args: args{
+				values:       map[string]string{},
+				kubeVersion:  "1.36",
+				namespace:    "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: cpiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/controlplane", "kubernetes.io/os"},
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node-role.kubernetes.io/master",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+				},
+			},
+		},
+		{
+			name: "Default with nodeSelector",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.nodeSelector.infra": "cpi",
+				},
+				kubeVersion:          "1.36",
+				namespace:            "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         cpiChart,
+				expectedNodeSelector: map[string]string{"kubernetes.io/os": "linux", "infra": "cpi"},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node-role.kubernetes.io/master",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+				},
+			},
+		},
+		{
+			name: "RKE1",
+			args: args{
+				values:       map[string]string{"global.distribution": "rke1"},
+				kubeVersion:  "1.36",
+				namespace:    "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: cpiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/controlplane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/etcd",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "RKE2",
+			args: args{
+				values:       map[string]string{"global.distribution": "rke2"},
+				kubeVersion:  "1.36",
+				namespace:    "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: cpiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "K3s",
+			args: args{
+				values:       map[string]string{"global.distribution": "k3s"},
+				kubeVersion:  "1.36",
+				namespace:    "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: cpiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/master",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "Generic",
+			args: args{
+				values:       map[string]string{"global.distribution": "generic"},
+				kubeVersion:  "1.36",
+				namespace:    "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: cpiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/master",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "RKE2 with nodeSelector, affinity and tolerations",
+			args: args{
+				values: map[string]string{
+					"global.distribution":                       "rke2",
+					"cloudControllerManager.nodeSelector.infra": "cpi",
+					"cloudControllerManager.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].key":       "kubernetes.io/arch",
+					"cloudControllerManager.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].operator":  "In",
+					"cloudControllerManager.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].values[0]": "amd64",
+					"cloudControllerManager.tolerations[0].key":      "dedicated",
+					"cloudControllerManager.tolerations[0].operator": "Exists",
+				},
+				kubeVersion:          "1.36",
+				namespace:            "cpitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "cpitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         cpiChart,
+				expectedNodeSelector: map[string]string{"kubernetes.io/os": "linux", "infra": "cpi"},
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os", "kubernetes.io/arch"},
+				},
+				expectedTolerationKeys: []string{
+					"node.cloudprovider.kubernetes.io/uninitialized",
+					"node.kubernetes.io/not-ready",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+					"dedicated",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+			podSpec := daemonSet.Spec.Template.Spec
+
+			// assert
+			require.Equal(t, tt.args.expectedNodeSelector, podSpec.NodeSelector)
+			require.Equal(t, tt.args.expectedTerms, requiredNodeSelectorKeys(podSpec.Affinity))
+			require.Equal(t, tt.args.expectedTolerationKeys, tolerationKeys(podSpec.Tolerations))
+		})
+	}
+}
+
+func TestCPITemplateRenderedDaemonsetInvalidDistribution(t *testing.T) {
+	// arrange
+	chartPath, err := filepath.Abs(cpiChart)
+	require.NoError(t, err)
+
+	namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+	releaseName := "cpitest-" + strings.ToLower(random.UniqueId())
+	options := &helm.Options{
+		SetValues:      map[string]string{"global.distribution": "openshift"},
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+	}
+
+	// act
+	_, err = helm.RenderTemplateE(t, options, chartPath, releaseName, []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", "1.36")
+
+	// assert
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "global.distribution must be one of")
+}
+
+func TestCPITemplateRenderedKind(t *testing.T) {
+	type args struct {
+		values                  map[string]string
+		expectedKind            string
+		expectedReplicas        int32
+		expectedPodAntiAffinity bool
+		expectedMaxUnavailable  string
+		expectedLeaderElectArgs []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "DaemonSet",
+			args: args{
+				values:                  map[string]string{},
+				expectedKind:            "DaemonSet",
+				expectedPodAntiAffinity: false,
+				expectedMaxUnavailable:  "",
+				expectedLeaderElectArgs: nil,
+			},
+		},
+		{
+			name: "Deployment",
+			args: args{
+				values:                  map[string]string{"cloudControllerManager.kind": "Deployment"},
+				expectedKind:            "Deployment",
+				expectedReplicas:        2,
+				expectedPodAntiAffinity: true,
+				expectedMaxUnavailable:  "1",
+				expectedLeaderElectArgs: []string{"--leader-elect=true"},
+			},
+		},
+		{
+			name: "Deployment with three replicas and no disruption budget",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.kind":                        "Deployment",
+					"cloudControllerManager.replicas":                    "3",
+					"cloudControllerManager.podDisruptionBudget.enabled": "false",
+				},
+				expectedKind:            "Deployment",
+				expectedReplicas:        3,
+				expectedPodAntiAffinity: true,
+				expectedMaxUnavailable:  "",
+				expectedLeaderElectArgs: []string{"--leader-elect=true"},
+			},
+		},
+		{
+			name: "Deployment with a distribution and a node selector",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.kind":                  "Deployment",
+					"global.distribution":                          "rke2",
+					"cloudControllerManager.nodeSelector.infra":    "cpi",
+					"cloudControllerManager.tolerations[0].key":    "node-role.kubernetes.io/infra",
+					"cloudControllerManager.tolerations[0].effect": "NoSchedule",
+				},
+				expectedKind:            "Deployment",
+				expectedReplicas:        2,
+				expectedPodAntiAffinity: true,
+				expectedMaxUnavailable:  "1",
+				expectedLeaderElectArgs: []string{"--leader-elect=true"},
+			},
+		},
+		{
+			name: "Single replica Deployment without leader election",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.kind":                   "Deployment",
+					"cloudControllerManager.replicas":               "1",
+					"cloudControllerManager.podAntiAffinity":        "null",
+					"cloudControllerManager.leaderElection.enabled": "false",
+				},
+				expectedKind:            "Deployment",
+				expectedReplicas:        1,
+				expectedPodAntiAffinity: false,
+				expectedMaxUnavailable:  "1",
+				expectedLeaderElectArgs: []string{"--leader-elect=false"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			namespace := "cpitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+			daemonSetValues := map[string]string{}
+			for key, value := range tt.args.values {
+				daemonSetValues[key] = value
+			}
+			daemonSetValues["cloudControllerManager.kind"] = "DaemonSet"
+			daemonSetOptions := &helm.Options{
+				SetValues:      daemonSetValues,
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", nil, "--kube-version", "1.36")
+			daemonSetOutput := helm.RenderTemplate(t, daemonSetOptions, chartPath, "cpitest", []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", "1.36")
+
+			// assert
+			var kind string
+			var replicas *int32
+			var podSpec v1.PodSpec
+			var pdb *policyv1.PodDisruptionBudget
+			for _, manifest := range splitManifests(output) {
+				var object map[string]interface{}
+				helm.UnmarshalK8SYaml(t, manifest, &object)
+				switch object["kind"] {
+				case "DaemonSet":
+					var daemonSet appsv1.DaemonSet
+					helm.UnmarshalK8SYaml(t, manifest, &daemonSet)
+					kind, podSpec = "DaemonSet", daemonSet.Spec.Template.Spec
+				case "Deployment":
+					var deployment appsv1.Deployment
+					helm.UnmarshalK8SYaml(t, manifest, &deployment)
+					kind, replicas, podSpec = "Deployment", deployment.Spec.Replicas, deployment.Spec.Template.Spec
+					require.Equal(t, deployment.Spec.Template.Labels["name"], deployment.Spec.Selector.MatchLabels["name"])
+				case "PodDisruptionBudget":
+					pdb = &policyv1.PodDisruptionBudget{}
+					helm.UnmarshalK8SYaml(t, manifest, pdb)
+				}
+			}
+			require.Equal(t, tt.args.expectedKind, kind)
+			if tt.args.expectedReplicas == 0 {
+				require.Nil(t, replicas)
+			} else {
+				require.NotNil(t, replicas)
+				require.Equal(t, tt.args.expectedReplicas, *replicas)
+			}
+			require.Equal(t, tt.args.expectedPodAntiAffinity, podSpec.Affinity != nil && podSpec.Affinity.PodAntiAffinity != nil)
+			if tt.args.expectedMaxUnavailable == "" {
+				require.Nil(t, pdb)
+			} else {
+				require.NotNil(t, pdb)
+				require.Equal(t, tt.args.expectedMaxUnavailable, pdb.Spec.MaxUnavailable.String())
+				require.Equal(t, map[string]string{"name": "rancher-vsphere-cpi-cloud-controller-manager"}, pdb.Spec.Selector.MatchLabels)
+			}
+			var leaderElectArgs []string
+			for _, arg := range podSpec.Containers[0].Args {
+				if strings.HasPrefix(arg, "--leader-elect=") {
+					leaderElectArgs = append(leaderElectArgs, arg)
+				}
+			}
+			require.Equal(t, tt.args.expectedLeaderElectArgs, leaderElectArgs)
+
+			// the workload kind does not change where the pods are scheduled
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, daemonSetOutput, &daemonSet)
+			require.Equal(t, daemonSet.Spec.Template.Spec.NodeSelector, podSpec.NodeSelector)
+			require.Equal(t, daemonSet.Spec.Template.Spec.Tolerations, podSpec.Tolerations)
+			require.Equal(t, requiredNodeSelectorKeys(daemonSet.Spec.Template.Spec.Affinity), requiredNodeSelectorKeys(podSpec.Affinity))
+			require.Contains(t, tolerationKeys(podSpec.Tolerations), "node.cloudprovider.kubernetes.io/uninitialized")
+		})
+	}
+}
+
+func TestCPITemplateRenderedKindInvalid(t *testing.T) {
+	type args struct {
+		values        map[string]string
+		expectedError string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Unknown kind",
+			args: args{
+				values:        map[string]string{"cloudControllerManager.kind": "StatefulSet"},
+				expectedError: "cloudControllerManager.kind must be DaemonSet or Deployment, got StatefulSet",
+			},
+		},
+		{
+			name: "Replicated Deployment without leader election",
+			args: args{
+				values: map[string]string{
+					"cloudControllerManager.kind":                   "Deployment",
+					"cloudControllerManager.leaderElection.enabled": "false",
+				},
+				expectedError: "cloudControllerManager.leaderElection.enabled must be true",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			_, err = helm.RenderTemplateE(t, options, chartPath, "cpitest", []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", "1.36")
+
+			// assert
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.args.expectedError)
+		})
+	}
+}
+
+func TestCPITemplateRenderedProxy(t *testing.T) {
+	type args struct {
+		values           map[string]string
+		expectedProxyEnv map[string]string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "No proxy",
+			args: args{
+				values:           map[string]string{"global.proxy.noProxy": "vcenter.example.com"},
+				expectedProxyEnv: map[string]string{},
+			},
+		},
+		{
+			name: "HTTPS proxy",
+			args: args{
+				values: map[string]string{"global.proxy.httpsProxy": "http://proxy.example.com:3128"},
+				expectedProxyEnv: map[string]string{
+					"HTTPS_PROXY": "http://proxy.example.com:3128",
+					"NO_PROXY":    "127.0.0.1,localhost,.svc,.cluster.local,10.43.0.0/16",
+				},
+			},
+		},
+		{
+			name: "HTTP and HTTPS proxy with no proxy hosts and service CIDR",
+			args: args{
+				values: map[string]string{
+					"global.proxy.httpProxy":   "http://proxy.example.com:3128",
+					"global.proxy.httpsProxy":  "http://proxy.example.com:3129",
+					"global.proxy.noProxy":     "vcenter.example.com\\, 192.168.0.0/16",
+					"global.proxy.serviceCidr": "10.45.0.0/16\\,fd00:45::/112",
+				},
+				expectedProxyEnv: map[string]string{
+					"HTTP_PROXY":  "http://proxy.example.com:3128",
+					"HTTPS_PROXY": "http://proxy.example.com:3129",
+					"NO_PROXY":    "vcenter.example.com,192.168.0.0/16,127.0.0.1,localhost,.svc,.cluster.local,10.45.0.0/16,fd00:45::/112",
+				},
+			},
+		},
+		{
+			name: "Generic distribution",
+			args: args{
+				values: map[string]string{
+					"global.distribution":     "generic",
+					"global.proxy.httpsProxy": "http://proxy.example.com:3128",
+				},
+				expectedProxyEnv: map[string]string{
+					"HTTPS_PROXY": "http://proxy.example.com:3128",
+					"NO_PROXY":    "127.0.0.1,localhost,.svc,.cluster.local,10.96.0.0/12",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", "1.36")
+
+			// assert
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+			require.Len(t, daemonSet.Spec.Template.Spec.Containers, 1)
+			require.Equal(t, tt.args.expectedProxyEnv, proxyEnv(daemonSet.Spec.Template.Spec.Containers[0]))
+		})
+	}
+}
+
+func TestCPITemplateRenderedTestPod(t *testing.T) {
+	type args struct {
+		values map[string]string
+		// expectedConfigMap and expectedSecret are empty when no test pod is rendered
+		expectedConfigMap string
+		expectedSecret    string
+		expectedRendered  bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Generated config and credentials",
+			args: args{
+				values:            map[string]string{},
+				expectedConfigMap: "vsphere-cloud-config",
+				expectedSecret:    "vsphere-cpi-creds",
+				expectedRendered:  true,
+			},
+		},
+		{
+			name: "Generated config and credentials with custom names",
+			args: args{
+				values: map[string]string{
+					"vCenter.cloudConfig.name":       "cpi-config",
+					"vCenter.credentialsSecret.name": "cpi-creds",
+				},
+				expectedConfigMap: "cpi-config",
+				expectedSecret:    "cpi-creds",
+				expectedRendered:  true,
+			},
+		},
+		{
+			name: "Existing config and credentials",
+			args: args{
+				values: map[string]string{
+					"vCenter.cloudConfig.generate":       "false",
+					"vCenter.cloudConfig.name":           "cpi-config",
+					"vCenter.credentialsSecret.generate": "false",
+					"vCenter.credentialsSecret.name":     "cpi-creds",
+				},
+				expectedConfigMap: "cpi-config",
+				expectedSecret:    "cpi-creds",
+				expectedRendered:  false,
+			},
+		},
+		{
+			name: "Tests disabled",
+			args: args{
+				values:            map[string]string{"tests.enabled": "false"},
+				expectedConfigMap: "",
+				expectedSecret:    "",
+				expectedRendered:  false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+
+			values := map[string]string{
+				"vCenter.host":        "vcenter.example.com",
+				"vCenter.datacenters": "DC0",
+				"vCenter.username":    "administrator@vsphere.local",
+				"vCenter.password":    random.UniqueId(),
+			}
+			maps.Copy(values, tt.args.values)
+			options := &helm.Options{
+				SetValues:      values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "cpitest", nil, "--kube-version", "1.36")
+
+			// assert
+			var pod *v1.Pod
+			rendered := map[string]bool{}
+			for _, manifest := range splitManifests(output) {
+				var object struct {
+					Kind     string `json:"kind"`
+					Metadata struct {
+						Name string `json:"name"`
+					} `json:"metadata"`
+				}
+				helm.UnmarshalK8SYaml(t, manifest, &object)
+				rendered[object.Kind+"/"+object.Metadata.Name] = true
+				if object.Kind == "Pod" {
+					pod = &v1.Pod{}
+					helm.UnmarshalK8SYaml(t, manifest, pod)
+				}
+			}
+			if tt.args.expectedConfigMap == "" {
+				require.Nil(t, pod)
+				return
+			}
+			require.NotNil(t, pod)
+			require.Equal(t, "test", pod.Annotations["helm.sh/hook"])
+			require.Equal(t, v1.RestartPolicyNever, pod.Spec.RestartPolicy)
+			require.Len(t, pod.Spec.Containers, 1)
+			container := pod.Spec.Containers[0]
+			require.Equal(t, []v1.EnvVar{
+				{Name: "CONFIG_FORMAT", Value: "cpi"},
+				{Name: "CONFIG_FILE", Value: "/etc/cloud/vsphere.yaml"},
+				{Name: "CREDENTIALS_DIR", Value: "/etc/vsphere-credentials"},
+			}, container.Env)
+			require.Contains(t, container.Command[len(container.Command)-1], "FindByInventoryPath")
+
+			volumes := map[string]v1.VolumeSource{}
+			for _, volume := range pod.Spec.Volumes {
+				volumes[volume.Name] = volume.VolumeSource
+			}
+			for _, mount := range container.VolumeMounts {
+				require.Contains(t, volumes, mount.Name)
+			}
+			require.NotNil(t, volumes["vsphere-config-volume"].ConfigMap)
+			require.Equal(t, tt.args.expectedConfigMap, volumes["vsphere-config-volume"].ConfigMap.Name)
+			require.NotNil(t, volumes["vsphere-credentials"].Secret)
+			require.Equal(t, tt.args.expectedSecret, volumes["vsphere-credentials"].Secret.SecretName)
+			require.Equal(t, tt.args.expectedRendered, rendered["ConfigMap/"+tt.args.expectedConfigMap])
+			require.Equal(t, tt.args.expectedRendered, rendered["Secret/"+tt.args.expectedSecret])
+		})
+	}
+}
+
+// withoutVersionOverride removes the versionOverrides entry of constraint, as if the CPI of
+// that Kubernetes minor was not released yet.
+func withoutVersionOverride(v *values.CPI, constraint string) {
+	v.VersionOverrides = slices.DeleteFunc(v.VersionOverrides, func(override values.VersionOverride[values.CPIOverrides]) bool {
+		return override.Constraint == constraint
+	})
+}
+
+func TestCPITemplateRenderedVersionSkew(t *testing.T) {
+	type args struct {
+		kubeVersion string
+		values      func(*values.CPI)
+		// expectedError is part of the render error, the render succeeds when empty
+		expectedError string
+		expectedImage string
+		// expectedWarning is part of the warning of the release notes, none when empty
+		expectedWarning string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Released minor",
+			args: args{
+				kubeVersion:   "1.36",
+				values:        func(v *values.CPI) {},
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+			},
+		},
+		{
+			name: "Supported minor without a CPI release",
+			args: args{
+				kubeVersion:     "1.36",
+				values:          func(v *values.CPI) { withoutVersionOverride(v, "~ 1.36") },
+				expectedImage:   "rancher/mirrored-cloud-provider-vsphere:v1.35.1",
+				expectedWarning: "no CPI release for Kubernetes v1.36.0, so the CPI release of Kubernetes 1.35 is used",
+			},
+		},
+		{
+			name: "New minor",
+			args: args{
+				kubeVersion:     "1.37",
+				values:          func(v *values.CPI) {},
+				expectedImage:   "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedWarning: "is used, as allowed by the version skew policy of the cloud controller manager. Kubernetes v1.37.0 is also outside the Kubernetes versions >= 1.27.0-0 < 1.37.0-0 of the chart.",
+			},
+		},
+		{
+			name: "New minor allowed",
+			args: args{
+				kubeVersion:     "1.37",
+				values:          func(v *values.CPI) { v.AllowUnsupportedKubeVersion = true },
+				expectedImage:   "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+				expectedWarning: "no CPI release for Kubernetes v1.37.0, so the CPI release of Kubernetes 1.36 is used",
+			},
+		},
+		{
+			name: "Minor two ahead of the newest release",
+			args: args{
+				kubeVersion:   "1.38",
+				values:        func(v *values.CPI) {},
+				expectedError: "Kubernetes v1.38.0 is not supported by rancher-vsphere-cpi",
+			},
+		},
+		{
+			name: "Minor two ahead of the newest release allowed",
+			args: args{
+				kubeVersion:   "1.38",
+				values:        func(v *values.CPI) { v.AllowUnsupportedKubeVersion = true },
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:latest",
+			},
+		},
+		{
+			name: "Fallback disabled on a new minor",
+			args: args{
+				kubeVersion:   "1.37",
+				values:        func(v *values.CPI) { v.VersionSkewFallback = false },
+				expectedError: "Kubernetes v1.37.0 is not supported by rancher-vsphere-cpi",
+			},
+		},
+		{
+			name: "Fallback disabled on a new minor allowed",
+			args: args{
+				kubeVersion: "1.37",
+				values: func(v *values.CPI) {
+					v.AllowUnsupportedKubeVersion = true
+					v.VersionSkewFallback = false
+				},
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:latest",
+			},
+		},
+		{
+			name: "Fallback disabled on a supported minor without a CPI release",
+			args: args{
+				kubeVersion: "1.36",
+				values: func(v *values.CPI) {
+					withoutVersionOverride(v, "~ 1.36")
+					v.VersionSkewFallback = false
+				},
+				expectedError: "no versionOverrides entry of rancher-vsphere-cpi",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+			valuesFile := cpiValuesFile(t, chartPath, tt.args.values)
+			options := &helm.Options{
+				ValuesFiles:    []string{valuesFile},
+				KubectlOptions: k8s.NewKubectlOptions("", "", "cpitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output, err := helm.RenderTemplateE(t, options, chartPath, "cpitest", []string{"templates/cloud-controller-manager.yaml"}, "--kube-version", tt.args.kubeVersion)
+			notes, notesErr := renderNotes(t, options, chartPath, "--kube-version", tt.args.kubeVersion)
+
+			// assert
+			if tt.args.expectedError != "" {
+				require.ErrorContains(t, err, tt.args.expectedError)
+				require.ErrorContains(t, notesErr, tt.args.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, notesErr)
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+			require.Equal(t, tt.args.expectedImage, daemonSet.Spec.Template.Spec.Containers[0].Image)
+			require.Contains(t, notes, tt.args.expectedImage)
+			if tt.args.expectedWarning != "" {
+				require.Contains(t, notes, "WARNING: ")
+				require.Contains(t, notes, tt.args.expectedWarning)
+			} else {
+				require.NotContains(t, notes, "WARNING")
+			}
+
+			// pkg/values resolves the same image
+			v, err := values.LoadCPI(valuesFile)
+			require.NoError(t, err)
+			require.NoError(t, v.ApplyVersionOverrides(tt.args.kubeVersion))
+			require.Equal(t, tt.args.expectedImage, v.ImageReferences()["cloudControllerManager"])
+		})
+	}
 }
@@ -1,15 +1,23 @@
 package unit
 
 import (
+	"fmt"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
 	"github.com/gruntwork-io/terratest/modules/helm"
 	"github.com/gruntwork-io/terratest/modules/k8s"
 	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/values"
 	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 const csiChart = "../../charts/rancher-vsphere-csi"
@@ -69,12 +77,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.36",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.36",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -103,12 +112,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.35",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.35",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -137,12 +147,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.34",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.34",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -171,12 +182,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.32",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.32",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -205,12 +217,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.32",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.32",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -239,12 +252,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.31",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.31",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
@@ -273,12 +287,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.30",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.30",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.12.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
@@ -307,12 +322,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.29",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.29",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.12.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
@@ -341,12 +357,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.28",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.28",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.12.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
@@ -375,12 +392,13 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 			args: args{
 				values: map[string]string{
 					"vCenter.clusterId":         random.UniqueId(),
-					"csiWindowsSupport:enabled": "true",
+					"csiWindowsSupport.enabled": "true",
 				},
-				kubeVersion:  "1.27",
-				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
-				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
-				chartRelPath: csiChart,
+				kubeVersion:    "1.27",
+				namespace:      "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:    "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:   csiChart,
+				windowsEnabled: true,
 				expectedImages: []string{
 					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.10.0",
 					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.2.0",
@@ -419,7 +437,7 @@ func TestCSITemplateRenderedNodeDaemonset(t *testing.T) {
 				windowsOutput := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/node/windows-daemonset.yaml"}, "--kube-version", tt.args.kubeVersion)
 
 				var windowsDaemonSet appsv1.DaemonSet
-				helm.UnmarshalK8SYaml(t, windowsOutput, &daemonSet)
+				helm.UnmarshalK8SYaml(t, windowsOutput, &windowsDaemonSet)
 
 				// assert
 				require.Equal(t, tt.args.namespace, windowsDaemonSet.Namespace)
@@ -1183,3 +1201,2156 @@ func TestCSITemplateRenderedNodeDaemonSetArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestCSITemplateRenderedControllerDeploymentScheduling(t *testing.T) {
+	type args struct {
+		values                             map[string]string
+		kubeVersion                        string
+		namespace                          string
+		releaseName                        string
+		chartRelPath                       string
+		expectedPriorityClassName          string
+		expectedNodeAffinity               bool
+		expectedPodAntiAffinityTopologyKey string
+		expectedTopologySpreadKeys         []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Defaults",
+			args: args{
+				values:                             map[string]string{"vCenter.clusterId": random.UniqueId()},
+				kubeVersion:                        "1.36",
+				namespace:                          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:                        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:                       csiChart,
+				expectedPriorityClassName:          "system-cluster-critical",
+				expectedNodeAffinity:               true,
+				expectedPodAntiAffinityTopologyKey: "kubernetes.io/hostname",
+			},
+		},
+		{
+			name: "Custom priority class",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":               random.UniqueId(),
+					"csiController.priorityClassName": "infra-critical",
+				},
+				kubeVersion:                        "1.36",
+				namespace:                          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:                        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:                       csiChart,
+				expectedPriorityClassName:          "infra-critical",
+				expectedNodeAffinity:               true,
+				expectedPodAntiAffinityTopologyKey: "kubernetes.io/hostname",
+			},
+		},
+		{
+			name: "Node selector keeps pod anti-affinity",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.nodeSelector.infra": "storage",
+				},
+				kubeVersion:                        "1.36",
+				namespace:                          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:                        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:                       csiChart,
+				expectedPriorityClassName:          "system-cluster-critical",
+				expectedNodeAffinity:               false,
+				expectedPodAntiAffinityTopologyKey: "kubernetes.io/hostname",
+			},
+		},
+		{
+			name: "Pod anti-affinity overridden by affinity",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId": random.UniqueId(),
+					"csiController.affinity.podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution[0].weight":                                        "50",
+					"csiController.affinity.podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution[0].podAffinityTerm.topologyKey":                   "topology.kubernetes.io/zone",
+					"csiController.affinity.podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution[0].podAffinityTerm.labelSelector.matchLabels.app": "vsphere-csi-controller",
+				},
+				kubeVersion:                        "1.36",
+				namespace:                          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:                        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:                       csiChart,
+				expectedPriorityClassName:          "system-cluster-critical",
+				expectedNodeAffinity:               true,
+				expectedPodAntiAffinityTopologyKey: "topology.kubernetes.io/zone",
+			},
+		},
+		{
+			name: "Pod anti-affinity disabled with topology spread constraints",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                                            random.UniqueId(),
+					"csiController.podAntiAffinity":                                "null",
+					"csiController.topologySpreadConstraints[0].maxSkew":           "1",
+					"csiController.topologySpreadConstraints[0].topologyKey":       "topology.kubernetes.io/zone",
+					"csiController.topologySpreadConstraints[0].whenUnsatisfiable": "ScheduleAnyway",
+				},
+				kubeVersion:                "1.36",
+				namespace:                  "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:                "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:               csiChart,
+				expectedPriorityClassName:  "system-cluster-critical",
+				expectedNodeAffinity:       true,
+				expectedTopologySpreadKeys: []string{"topology.kubernetes.io/zone"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/deployment.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, output, &deployment)
+			podSpec := deployment.Spec.Template.Spec
+
+			// assert
+			require.Equal(t, tt.args.expectedPriorityClassName, podSpec.PriorityClassName)
+			if tt.args.expectedNodeAffinity {
+				require.NotNil(t, podSpec.Affinity)
+				require.NotNil(t, podSpec.Affinity.NodeAffinity)
+			} else if podSpec.Affinity != nil {
+				require.Nil(t, podSpec.Affinity.NodeAffinity)
+			}
+			if tt.args.expectedPodAntiAffinityTopologyKey != "" {
+				require.NotNil(t, podSpec.Affinity)
+				require.NotNil(t, podSpec.Affinity.PodAntiAffinity)
+				terms := podSpec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+				require.Equal(t, 1, len(terms))
+				require.Equal(t, tt.args.expectedPodAntiAffinityTopologyKey, terms[0].PodAffinityTerm.TopologyKey)
+				require.Equal(t, "vsphere-csi-controller", terms[0].PodAffinityTerm.LabelSelector.MatchLabels["app"])
+			} else if podSpec.Affinity != nil {
+				require.Nil(t, podSpec.Affinity.PodAntiAffinity)
+			}
+			require.Equal(t, len(tt.args.expectedTopologySpreadKeys), len(podSpec.TopologySpreadConstraints))
+			for i := range tt.args.expectedTopologySpreadKeys {
+				require.Equal(t, tt.args.expectedTopologySpreadKeys[i], podSpec.TopologySpreadConstraints[i].TopologyKey)
+			}
+		})
+	}
+}
+
+func TestCSITemplateRenderedNodePriorityClass(t *testing.T) {
+	type args struct {
+		values                    func(*values.CSI)
+		kubeVersion               string
+		namespace                 string
+		releaseName               string
+		chartRelPath              string
+		templates                 []string
+		expectedPriorityClassName string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Linux default priority class",
+			args: args{
+				values:                    func(*values.CSI) {},
+				kubeVersion:               "1.36",
+				namespace:                 "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              csiChart,
+				templates:                 []string{"templates/node/daemonset.yaml"},
+				expectedPriorityClassName: "system-node-critical",
+			},
+		},
+		{
+			name: "Windows default priority class",
+			args: args{
+				values: func(v *values.CSI) {
+					v.CSIWindowsSupport.Enabled = true
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              csiChart,
+				templates:                 []string{"templates/node/windows-daemonset.yaml"},
+				expectedPriorityClassName: "system-node-critical",
+			},
+		},
+		{
+			name: "Custom priority class",
+			args: args{
+				values: func(v *values.CSI) {
+					v.CSINode.PriorityClassName = "storage-critical"
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              csiChart,
+				templates:                 []string{"templates/node/daemonset.yaml"},
+				expectedPriorityClassName: "storage-critical",
+			},
+		},
+		{
+			name: "Windows custom Linux priority class",
+			args: args{
+				values: func(v *values.CSI) {
+					v.CSIWindowsSupport.Enabled = true
+					v.CSINode.PriorityClassName = "storage-critical"
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              csiChart,
+				templates:                 []string{"templates/node/windows-daemonset.yaml"},
+				expectedPriorityClassName: "storage-critical",
+			},
+		},
+		{
+			name: "Windows custom priority class",
+			args: args{
+				values: func(v *values.CSI) {
+					v.CSIWindowsSupport.Enabled = true
+					v.CSINode.PriorityClassName = "storage-critical"
+					v.CSINodeWindows.PriorityClassName = "windows-critical"
+				},
+				kubeVersion:               "1.36",
+				namespace:                 "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:               "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:              csiChart,
+				templates:                 []string{"templates/node/windows-daemonset.yaml"},
+				expectedPriorityClassName: "windows-critical",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				ValuesFiles:    []string{csiValuesFile(t, chartPath, tt.args.values)},
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, tt.args.templates, "--kube-version", tt.args.kubeVersion)
+
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+
+			// assert
+			require.Equal(t, tt.args.expectedPriorityClassName, daemonSet.Spec.Template.Spec.PriorityClassName)
+		})
+	}
+}
+
+func TestCSITemplateRenderedControllerDeploymentDistribution(t *testing.T) {
+	type args struct {
+		values                 map[string]string
+		kubeVersion            string
+		namespace              string
+		releaseName            string
+		chartRelPath           string
+		expectedNodeSelector   map[string]string
+		expectedTerms          [][]string
+		expectedTolerationKeys []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default",
+			args: args{
+				values:       map[string]string{"vCenter.clusterId": random.UniqueId()},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/controlplane", "kubernetes.io/os"},
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/master",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+				},
+			},
+		},
+		{
+			name: "Default with affinity",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId": random.UniqueId(),
+					"csiController.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].key":       "kubernetes.io/arch",
+					"csiController.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].operator":  "In",
+					"csiController.affinity.nodeAffinity.requiredDuringSchedulingIgnoredDuringExecution.nodeSelectorTerms[0].matchExpressions[0].values[0]": "arm64",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/controlplane", "kubernetes.io/os", "kubernetes.io/arch"},
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os", "kubernetes.io/arch"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/master",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+				},
+			},
+		},
+		{
+			name: "RKE1",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":   random.UniqueId(),
+					"global.distribution": "rke1",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/controlplane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/etcd",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "RKE2",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":   random.UniqueId(),
+					"global.distribution": "rke2",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "K3s",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":   random.UniqueId(),
+					"global.distribution": "k3s",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/master",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "Generic",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":   random.UniqueId(),
+					"global.distribution": "generic",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/master",
+					"cattle.io/os",
+				},
+			},
+		},
+		{
+			name: "Generic with nodeSelector",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"global.distribution":              "generic",
+					"csiController.nodeSelector.infra": "storage",
+				},
+				kubeVersion:          "1.36",
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedNodeSelector: map[string]string{"kubernetes.io/os": "linux", "infra": "storage"},
+				expectedTerms: [][]string{
+					{"node-role.kubernetes.io/control-plane", "kubernetes.io/os"},
+				},
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/master",
+					"cattle.io/os",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/deployment.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, output, &deployment)
+			podSpec := deployment.Spec.Template.Spec
+
+			// assert
+			require.Equal(t, tt.args.expectedNodeSelector, podSpec.NodeSelector)
+			require.Equal(t, tt.args.expectedTerms, requiredNodeSelectorKeys(podSpec.Affinity))
+			require.Equal(t, tt.args.expectedTolerationKeys, tolerationKeys(podSpec.Tolerations))
+		})
+	}
+}
+
+func TestCSITemplateRenderedNodeDaemonsetDistribution(t *testing.T) {
+	type args struct {
+		values                 map[string]string
+		kubeVersion            string
+		namespace              string
+		releaseName            string
+		chartRelPath           string
+		expectedTolerationKeys []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Default",
+			args: args{
+				values:       map[string]string{"vCenter.clusterId": random.UniqueId()},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/master",
+					"node-role.kubernetes.io/controlplane",
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+				},
+			},
+		},
+		{
+			name: "RKE2 with tolerations",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":               random.UniqueId(),
+					"global.distribution":             "rke2",
+					"csiNode.tolerations[0].key":      "storage",
+					"csiNode.tolerations[0].operator": "Exists",
+				},
+				kubeVersion:  "1.36",
+				namespace:    "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:  "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath: csiChart,
+				expectedTolerationKeys: []string{
+					"node-role.kubernetes.io/control-plane",
+					"node-role.kubernetes.io/etcd",
+					"CriticalAddonsOnly",
+					"cattle.io/os",
+					"storage",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/node/daemonset.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+
+			// assert
+			require.Equal(t, [][]string{{"kubernetes.io/os"}}, requiredNodeSelectorKeys(daemonSet.Spec.Template.Spec.Affinity))
+			require.Equal(t, tt.args.expectedTolerationKeys, tolerationKeys(daemonSet.Spec.Template.Spec.Tolerations))
+		})
+	}
+}
+
+func TestCSITemplateRenderedWindowsNodeDaemonset(t *testing.T) {
+	type args struct {
+		values                   map[string]string
+		kubeVersion              string
+		namespace                string
+		releaseName              string
+		chartRelPath             string
+		expectedPrefixPath       string
+		expectedImages           []string
+		expectedPullPolicies     []v1.PullPolicy
+		expectedNodeSelector     map[string]string
+		expectedTolerationKeys   []string
+		expectedImagePullSecrets []string
+		expectedHostProcess      bool
+	}
+	defaultTolerationKeys := []string{
+		"node-role.kubernetes.io/master",
+		"node-role.kubernetes.io/controlplane",
+		"node-role.kubernetes.io/control-plane",
+		"node-role.kubernetes.io/etcd",
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Defaults",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":         random.UniqueId(),
+					"csiWindowsSupport.enabled": "true",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "C:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
+					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.15.0",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: defaultTolerationKeys,
+			},
+		},
+		{
+			name: "Prefix path",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":         random.UniqueId(),
+					"csiWindowsSupport.enabled": "true",
+					"csiNode.prefixPathWindows": "D:",
+				},
+				kubeVersion:        "1.30",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "D:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.12.0",
+					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.14.0",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: defaultTolerationKeys,
+			},
+		},
+		{
+			name: "Windows image overrides and scheduling",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                                   random.UniqueId(),
+					"csiWindowsSupport.enabled":                           "true",
+					"csiNodeWindows.image.repository":                     "example/vsphere-csi-driver-windows",
+					"csiNodeWindows.image.imagePullPolicy":                "IfNotPresent",
+					"csiNodeWindows.image.nodeDriverRegistrar.tag":        "v2.13.0-windows",
+					"csiNodeWindows.image.livenessProbe.imagePullPolicy":  "Never",
+					"csiNodeWindows.nodeSelector.windows-build":           "ltsc2022",
+					"csiNodeWindows.tolerations[0].key":                   "os",
+					"csiNodeWindows.tolerations[0].operator":              "Exists",
+					"csiNodeWindows.imagePullSecrets[0].name":             "windows-registry",
+					"global.imagePullSecrets[0].name":                     "registry",
+					"csiNode.image.nodeDriverRegistrar.additionalArgs[0]": "--linux-only",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "C:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0-windows",
+					"example/vsphere-csi-driver-windows:v3.7.2",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.15.0",
+				},
+				expectedPullPolicies:     []v1.PullPolicy{"", v1.PullIfNotPresent, v1.PullNever},
+				expectedNodeSelector:     map[string]string{"kubernetes.io/os": "windows", "windows-build": "ltsc2022"},
+				expectedTolerationKeys:   []string{"os"},
+				expectedImagePullSecrets: []string{"registry", "windows-registry"},
+			},
+		},
+		{
+			name: "Linux tolerations fallback",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":               random.UniqueId(),
+					"csiWindowsSupport.enabled":       "true",
+					"csiNode.tolerations[0].key":      "storage",
+					"csiNode.tolerations[0].operator": "Exists",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "C:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
+					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.15.0",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: []string{"storage"},
+			},
+		},
+		{
+			name: "Prime with system default registry",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                   random.UniqueId(),
+					"csiWindowsSupport.enabled":           "true",
+					"global.prime.enabled":                "true",
+					"global.cattle.systemDefaultRegistry": "registry.rancher.com",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "C:",
+				expectedImages: []string{
+					"registry.rancher.com/rancher/hardened-csi-node-driver-registrar:v2.17.0-build20260722",
+					"registry.rancher.com/rancher/hardened-vsphere-csi-driver:v3.7.2-build20260722",
+					"registry.rancher.com/rancher/hardened-livenessprobe:v2.19.0-build20260722",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: defaultTolerationKeys,
+			},
+		},
+		{
+			name: "Host process",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                  random.UniqueId(),
+					"csiWindowsSupport.enabled":          "true",
+					"csiNodeWindows.hostProcess.enabled": "true",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "C:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
+					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.15.0",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: defaultTolerationKeys,
+				expectedHostProcess:    true,
+			},
+		},
+		{
+			name: "Host process with a prefix path",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                  random.UniqueId(),
+					"csiWindowsSupport.enabled":          "true",
+					"csiNodeWindows.hostProcess.enabled": "true",
+					"csiNode.prefixPathWindows":          "D:",
+				},
+				kubeVersion:        "1.36",
+				namespace:          "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:        "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:       csiChart,
+				expectedPrefixPath: "D:",
+				expectedImages: []string{
+					"rancher/mirrored-sig-storage-csi-node-driver-registrar:v2.13.0",
+					"rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+					"rancher/mirrored-sig-storage-livenessprobe:v2.15.0",
+				},
+				expectedPullPolicies:   []v1.PullPolicy{"", v1.PullAlways, ""},
+				expectedNodeSelector:   map[string]string{"kubernetes.io/os": "windows"},
+				expectedTolerationKeys: defaultTolerationKeys,
+				expectedHostProcess:    true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+			prefix := tt.args.expectedPrefixPath
+			socketPath := prefix + `\\var\\lib\\kubelet\\plugins\\csi.vsphere.vmware.com\\csi.sock`
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/node/windows-daemonset.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, output, &daemonSet)
+			podSpec := daemonSet.Spec.Template.Spec
+
+			// assert
+			require.Equal(t, tt.args.namespace, daemonSet.Namespace)
+			require.NotContains(t, output, `imagePullPolicy: ""`)
+			require.Equal(t, tt.args.expectedNodeSelector, podSpec.NodeSelector)
+			require.Equal(t, tt.args.expectedTolerationKeys, tolerationKeys(podSpec.Tolerations))
+			var imagePullSecrets []string
+			for _, secret := range podSpec.ImagePullSecrets {
+				imagePullSecrets = append(imagePullSecrets, secret.Name)
+			}
+			require.Equal(t, tt.args.expectedImagePullSecrets, imagePullSecrets)
+
+			require.Equal(t, len(tt.args.expectedImages), len(podSpec.Containers))
+			for i := range tt.args.expectedImages {
+				require.Equal(t, tt.args.expectedImages[i], podSpec.Containers[i].Image)
+				require.Equal(t, tt.args.expectedPullPolicies[i], podSpec.Containers[i].ImagePullPolicy)
+			}
+
+			registrar := podSpec.Containers[0]
+			require.Equal(t, "node-driver-registrar", registrar.Name)
+			require.NotContains(t, registrar.Args, "--linux-only")
+			env := map[string]string{}
+			for _, e := range registrar.Env {
+				env[e.Name] = e.Value
+			}
+			require.Equal(t, socketPath, env["DRIVER_REG_SOCK_PATH"])
+			require.Contains(t, registrar.LivenessProbe.Exec.Command, "--kubelet-registration-path="+socketPath)
+
+			driver := podSpec.Containers[1]
+			require.Equal(t, "vsphere-csi-node", driver.Name)
+			driverEnv := map[string]string{}
+			for _, e := range driver.Env {
+				driverEnv[e.Name] = e.Value
+			}
+			mounts := map[string]string{}
+			for _, mount := range driver.VolumeMounts {
+				mounts[mount.Name] = mount.MountPath
+			}
+
+			livenessProbe := podSpec.Containers[2]
+			require.Equal(t, "liveness-probe", livenessProbe.Name)
+
+			hostPaths := map[string]string{}
+			for _, volume := range podSpec.Volumes {
+				require.NotNil(t, volume.HostPath)
+				hostPaths[volume.Name] = volume.HostPath.Path
+			}
+			require.Equal(t, prefix+`\var\lib\kubelet\plugins\csi.vsphere.vmware.com\`, hostPaths["plugin-dir"])
+			pipes := []string{"csi-proxy-disk-v1", "csi-proxy-volume-v1", "csi-proxy-filesystem-v1", "csi-proxy-system-v1alpha1"}
+
+			if tt.args.expectedHostProcess {
+				require.True(t, podSpec.HostNetwork)
+				require.NotNil(t, podSpec.SecurityContext)
+				require.NotNil(t, podSpec.SecurityContext.WindowsOptions)
+				require.True(t, *podSpec.SecurityContext.WindowsOptions.HostProcess)
+				require.Equal(t, `NT AUTHORITY\SYSTEM`, *podSpec.SecurityContext.WindowsOptions.RunAsUserName)
+
+				// HostProcess containers reach the socket at its host path, without mounts or csi-proxy
+				require.Equal(t, "unix://"+socketPath, env["ADDRESS"])
+				require.Equal(t, "unix://"+socketPath, driverEnv["CSI_ENDPOINT"])
+				require.Contains(t, registrar.Args, "--plugin-registration-path="+prefix+`\var\lib\kubelet\plugins_registry`)
+				require.Contains(t, livenessProbe.Args, "--csi-address="+strings.ReplaceAll(socketPath, `\\`, `\`))
+				require.Equal(t, "csi-node-driver-registrar.exe", registrar.LivenessProbe.Exec.Command[0])
+				for _, container := range podSpec.Containers {
+					require.Empty(t, container.VolumeMounts, container.Name)
+				}
+				require.Equal(t, []string{"plugin-dir"}, slices.Collect(maps.Keys(hostPaths)))
+				return
+			}
+			require.False(t, podSpec.HostNetwork)
+			require.Nil(t, podSpec.SecurityContext)
+
+			require.Equal(t, `unix://C:\\csi\\csi.sock`, env["ADDRESS"])
+			require.Equal(t, `unix://C:\\csi\\csi.sock`, driverEnv["CSI_ENDPOINT"])
+			require.Contains(t, livenessProbe.Args, "--csi-address=/csi/csi.sock")
+			require.Equal(t, `C:\csi`, mounts["plugin-dir"])
+			require.Equal(t, `C:\var\lib\kubelet`, mounts["pods-mount-dir"])
+			require.Equal(t, prefix+`\var\lib\kubelet\plugins_registry\`, hostPaths["registration-dir"])
+			require.Equal(t, prefix+`\var\lib\kubelet`, hostPaths["pods-mount-dir"])
+			for _, pipe := range pipes {
+				require.Equal(t, `\\.\pipe\`+pipe, hostPaths[pipe])
+				require.Equal(t, `\\.\pipe\`+pipe, mounts[pipe])
+			}
+		})
+	}
+}
+
+func TestCSITemplateRenderedWindowsNodeDaemonsetDisabled(t *testing.T) {
+	// arrange
+	chartPath, err := filepath.Abs(csiChart)
+	require.NoError(t, err)
+
+	namespace := "csitest-" + strings.ToLower(random.UniqueId())
+	releaseName := "csitest-" + strings.ToLower(random.UniqueId())
+	options := &helm.Options{
+		SetValues:      map[string]string{"vCenter.clusterId": random.UniqueId()},
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+	}
+
+	// act
+	_, err = helm.RenderTemplateE(t, options, chartPath, releaseName, []string{"templates/node/windows-daemonset.yaml"}, "--kube-version", "1.36")
+
+	// assert
+	require.Error(t, err)
+}
+
+func TestCSITemplateRenderedWebhookDeployment(t *testing.T) {
+	type args struct {
+		values        map[string]string
+		kubeVersion   string
+		namespace     string
+		releaseName   string
+		chartRelPath  string
+		expectedImage string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Kubernetes 1.36",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+				},
+				kubeVersion:   "1.36",
+				namespace:     "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:   "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:  csiChart,
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-syncer:v3.7.2",
+			},
+		},
+		{
+			name: "Kubernetes 1.30",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+				},
+				kubeVersion:   "1.30",
+				namespace:     "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:   "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:  csiChart,
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-syncer:v3.3.1",
+			},
+		},
+		{
+			name: "Kubernetes 1.27",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+				},
+				kubeVersion:   "1.27",
+				namespace:     "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:   "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:  csiChart,
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-syncer:v3.2.0",
+			},
+		},
+		{
+			name: "Prime image",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+					"global.prime.enabled": "true",
+				},
+				kubeVersion:   "1.36",
+				namespace:     "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:   "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:  csiChart,
+				expectedImage: "rancher/hardened-vsphere-csi-syncer:v3.7.2-build20260722",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/webhook/deployment.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, output, &deployment)
+
+			// assert
+			require.Equal(t, "vsphere-csi-webhook", deployment.Spec.Template.Spec.ServiceAccountName)
+			require.Len(t, deployment.Spec.Template.Spec.Containers, 1)
+			container := deployment.Spec.Template.Spec.Containers[0]
+			require.Equal(t, tt.args.expectedImage, container.Image)
+			require.Contains(t, container.Args, "--operation-mode=WEBHOOK_SERVER")
+			require.Equal(t, int32(8443), container.Ports[0].ContainerPort)
+
+			secrets := map[string]string{}
+			for _, volume := range deployment.Spec.Template.Spec.Volumes {
+				if volume.Secret != nil {
+					secrets[volume.Name] = volume.Secret.SecretName
+				}
+			}
+			require.Equal(t, "vsphere-webhook-certs", secrets["webhook-certs"])
+		})
+	}
+}
+
+func TestCSITemplateRenderedWebhookCertificates(t *testing.T) {
+	type args struct {
+		values                map[string]string
+		kubeVersion           string
+		apiVersions           []string
+		namespace             string
+		releaseName           string
+		chartRelPath          string
+		expectedKinds         []string
+		expectedCertManager   bool
+		expectedFailurePolicy admissionregistrationv1.FailurePolicyType
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Self-signed certificates",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+				},
+				kubeVersion:           "1.36",
+				namespace:             "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:           "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:          csiChart,
+				expectedKinds:         []string{"Secret", "ValidatingWebhookConfiguration"},
+				expectedCertManager:   false,
+				expectedFailurePolicy: admissionregistrationv1.Fail,
+			},
+		},
+		{
+			name: "cert-manager disabled",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+					"certManager.enabled":  "false",
+				},
+				kubeVersion:           "1.36",
+				apiVersions:           []string{"cert-manager.io/v1"},
+				namespace:             "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:           "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:          csiChart,
+				expectedKinds:         []string{"Secret", "ValidatingWebhookConfiguration"},
+				expectedCertManager:   false,
+				expectedFailurePolicy: admissionregistrationv1.Fail,
+			},
+		},
+		{
+			name: "cert-manager with self-signed issuer",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":    random.UniqueId(),
+					"csiMigration.enabled": "true",
+				},
+				kubeVersion:           "1.36",
+				apiVersions:           []string{"cert-manager.io/v1"},
+				namespace:             "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:           "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:          csiChart,
+				expectedKinds:         []string{"Certificate", "ValidatingWebhookConfiguration"},
+				expectedCertManager:   true,
+				expectedFailurePolicy: admissionregistrationv1.Fail,
+			},
+		},
+		{
+			name: "cert-manager with existing issuer",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                  random.UniqueId(),
+					"csiMigration.enabled":               "true",
+					"certManager.issuerRef.name":         "cluster-ca",
+					"certManager.issuerRef.kind":         "ClusterIssuer",
+					"csiMigration.webhook.failurePolicy": "Ignore",
+				},
+				kubeVersion:           "1.36",
+				apiVersions:           []string{"cert-manager.io/v1"},
+				namespace:             "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:           "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:          csiChart,
+				expectedKinds:         []string{"Certificate", "ValidatingWebhookConfiguration"},
+				expectedCertManager:   true,
+				expectedFailurePolicy: admissionregistrationv1.Ignore,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+			extraArgs := []string{"--kube-version", tt.args.kubeVersion}
+			for _, apiVersion := range tt.args.apiVersions {
+				extraArgs = append(extraArgs, "--api-versions", apiVersion)
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/webhook/validatingwebhookconfiguration.yaml"}, extraArgs...)
+
+			var kinds []string
+			var secret v1.Secret
+			var webhookConfiguration admissionregistrationv1.ValidatingWebhookConfiguration
+			var certificate map[string]interface{}
+			for _, manifest := range splitManifests(output) {
+				var object map[string]interface{}
+				helm.UnmarshalK8SYaml(t, manifest, &object)
+				kinds = append(kinds, object["kind"].(string))
+				switch object["kind"] {
+				case "Secret":
+					helm.UnmarshalK8SYaml(t, manifest, &secret)
+				case "ValidatingWebhookConfiguration":
+					helm.UnmarshalK8SYaml(t, manifest, &webhookConfiguration)
+				case "Certificate":
+					certificate = object
+				}
+			}
+
+			// assert
+			require.Equal(t, tt.args.expectedKinds, kinds)
+			require.Len(t, webhookConfiguration.Webhooks, 1)
+			webhook := webhookConfiguration.Webhooks[0]
+			require.Equal(t, "vsphere-webhook-svc", webhook.ClientConfig.Service.Name)
+			require.Equal(t, tt.args.namespace, webhook.ClientConfig.Service.Namespace)
+			require.Equal(t, tt.args.expectedFailurePolicy, *webhook.FailurePolicy)
+
+			if tt.args.expectedCertManager {
+				require.Empty(t, webhook.ClientConfig.CABundle)
+				require.Equal(t, tt.args.namespace+"/vsphere-webhook-cert", webhookConfiguration.Annotations["cert-manager.io/inject-ca-from"])
+				spec := certificate["spec"].(map[string]interface{})
+				require.Equal(t, "vsphere-webhook-certs", spec["secretName"])
+				issuerRef := spec["issuerRef"].(map[string]interface{})
+				if name, ok := tt.args.values["certManager.issuerRef.name"]; ok {
+					require.Equal(t, name, issuerRef["name"])
+				} else {
+					require.Equal(t, "vsphere-csi-selfsigned", issuerRef["name"])
+				}
+			} else {
+				require.Equal(t, v1.SecretTypeTLS, secret.Type)
+				require.Equal(t, "vsphere-webhook-certs", secret.Name)
+				require.NotEmpty(t, secret.Data["tls.crt"])
+				require.NotEmpty(t, secret.Data["tls.key"])
+				require.Equal(t, secret.Data["ca.crt"], webhook.ClientConfig.CABundle)
+			}
+		})
+	}
+}
+
+func TestCSITemplateRenderedMigration(t *testing.T) {
+	type args struct {
+		values            map[string]string
+		kubeVersion       string
+		namespace         string
+		releaseName       string
+		chartRelPath      string
+		expectedRendered  bool
+		expectedConfigKey string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Migration disabled",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId": random.UniqueId(),
+				},
+				kubeVersion:       "1.36",
+				namespace:         "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      csiChart,
+				expectedRendered:  false,
+				expectedConfigKey: "false",
+			},
+		},
+		{
+			name: "Migration enabled",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                  random.UniqueId(),
+					"csiMigration.enabled":               "true",
+					"csiMigration.migrationDatastoreURL": "ds:///vmfs/volumes/datastore1/",
+				},
+				kubeVersion:       "1.36",
+				namespace:         "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:       "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:      csiChart,
+				expectedRendered:  true,
+				expectedConfigKey: "true",
+			},
+		},
+	}
+
+	webhookTemplates := []string{
+		"templates/webhook/configmap.yaml",
+		"templates/webhook/crd.yaml",
+		"templates/webhook/deployment.yaml",
+		"templates/webhook/role-binding.yaml",
+		"templates/webhook/role.yaml",
+		"templates/webhook/service-account.yaml",
+		"templates/webhook/service.yaml",
+		"templates/webhook/validatingwebhookconfiguration.yaml",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+
+			// act
+			configOutput := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/configmap.yaml"}, "--kube-version", tt.args.kubeVersion)
+			secretOutput := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/secret.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var configMap v1.ConfigMap
+			helm.UnmarshalK8SYaml(t, configOutput, &configMap)
+			var secret v1.Secret
+			helm.UnmarshalK8SYaml(t, secretOutput, &secret)
+
+			// assert
+			require.Equal(t, tt.args.expectedConfigKey, configMap.Data["csi-migration"])
+			if datastore, ok := tt.args.values["csiMigration.migrationDatastoreURL"]; ok {
+				require.Contains(t, string(secret.Data["csi-vsphere.conf"]), `migration-datastore-url = "`+datastore+`"`)
+			} else {
+				require.NotContains(t, string(secret.Data["csi-vsphere.conf"]), "migration-datastore-url")
+			}
+
+			for _, template := range webhookTemplates {
+				_, err := helm.RenderTemplateE(t, options, chartPath, tt.args.releaseName, []string{template}, "--kube-version", tt.args.kubeVersion)
+				if tt.args.expectedRendered {
+					require.NoError(t, err, template)
+				} else {
+					require.Error(t, err, template)
+				}
+			}
+
+			if tt.args.expectedRendered {
+				output := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/webhook/crd.yaml"}, "--kube-version", tt.args.kubeVersion)
+				var crd map[string]interface{}
+				helm.UnmarshalK8SYaml(t, output, &crd)
+				metadata := crd["metadata"].(map[string]interface{})
+				require.Equal(t, "cnsvspherevolumemigrations.cns.vmware.com", metadata["name"])
+				require.Equal(t, "keep", metadata["annotations"].(map[string]interface{})["helm.sh/resource-policy"])
+				// the syncer writes the lowercase fields of the upstream types
+				version := crd["spec"].(map[string]interface{})["versions"].([]interface{})[0].(map[string]interface{})
+				schema := version["schema"].(map[string]interface{})["openAPIV3Schema"].(map[string]interface{})
+				spec := schema["properties"].(map[string]interface{})["spec"].(map[string]interface{})
+				require.ElementsMatch(t, []string{"volumeid", "volumepath", "protectvolumefromvmdelete"}, slices.Collect(maps.Keys(spec["properties"].(map[string]interface{}))))
+				require.Equal(t, []interface{}{"volumeid", "volumepath"}, spec["required"])
+			}
+		})
+	}
+}
+
+func TestCSITemplateRenderedControllerMetricsTLS(t *testing.T) {
+	type args struct {
+		values               map[string]string
+		kubeVersion          string
+		apiVersions          []string
+		namespace            string
+		releaseName          string
+		chartRelPath         string
+		expectedMounted      bool
+		expectedKind         string
+		expectedIssuerRender bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Metrics TLS disabled",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId": random.UniqueId(),
+				},
+				kubeVersion:          "1.36",
+				apiVersions:          []string{"cert-manager.io/v1"},
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedMounted:      false,
+				expectedKind:         "",
+				expectedIssuerRender: false,
+			},
+		},
+		{
+			name: "Self-signed without cert-manager",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.metricsTLS.enabled": "true",
+				},
+				kubeVersion:          "1.36",
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedMounted:      true,
+				expectedKind:         "Secret",
+				expectedIssuerRender: false,
+			},
+		},
+		{
+			name: "cert-manager available",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.metricsTLS.enabled": "true",
+				},
+				kubeVersion:          "1.36",
+				apiVersions:          []string{"cert-manager.io/v1"},
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedMounted:      true,
+				expectedKind:         "Certificate",
+				expectedIssuerRender: true,
+			},
+		},
+		{
+			name: "cert-manager available with existing issuer",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.metricsTLS.enabled": "true",
+					"certManager.issuerRef.name":       "cluster-ca",
+					"certManager.issuerRef.kind":       "ClusterIssuer",
+				},
+				kubeVersion:          "1.36",
+				apiVersions:          []string{"cert-manager.io/v1"},
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedMounted:      true,
+				expectedKind:         "Certificate",
+				expectedIssuerRender: false,
+			},
+		},
+		{
+			name: "cert-manager available but disabled",
+			args: args{
+				values: map[string]string{
+					"vCenter.clusterId":                random.UniqueId(),
+					"csiController.metricsTLS.enabled": "true",
+					"certManager.enabled":              "false",
+				},
+				kubeVersion:          "1.36",
+				apiVersions:          []string{"cert-manager.io/v1"},
+				namespace:            "csitest-" + strings.ToLower(random.UniqueId()),
+				releaseName:          "csitest-" + strings.ToLower(random.UniqueId()),
+				chartRelPath:         csiChart,
+				expectedMounted:      true,
+				expectedKind:         "Secret",
+				expectedIssuerRender: false,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+
+			options := &helm.Options{
+				SetValues:      tt.args.values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", tt.args.namespace),
+			}
+			extraArgs := []string{"--kube-version", tt.args.kubeVersion}
+			for _, apiVersion := range tt.args.apiVersions {
+				extraArgs = append(extraArgs, "--api-versions", apiVersion)
+			}
+
+			// act
+			deploymentOutput := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/deployment.yaml"}, extraArgs...)
+			serviceOutput := helm.RenderTemplate(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/service.yaml"}, extraArgs...)
+			certificateOutput, certificateErr := helm.RenderTemplateE(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/metrics-certificate.yaml"}, extraArgs...)
+			_, issuerErr := helm.RenderTemplateE(t, options, chartPath, tt.args.releaseName, []string{"templates/issuer.yaml"}, extraArgs...)
+			networkPolicyOutput, networkPolicyErr := helm.RenderTemplateE(t, options, chartPath, tt.args.releaseName, []string{"templates/controller/network-policy.yaml"}, extraArgs...)
+
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, deploymentOutput, &deployment)
+
+			// assert
+			mounts := map[string]bool{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				for _, volumeMount := range container.VolumeMounts {
+					if volumeMount.Name == "metrics-tls" {
+						require.Equal(t, "/etc/vsphere-csi/tls", volumeMount.MountPath)
+						mounts[container.Name] = true
+					}
+				}
+			}
+			if tt.args.expectedMounted {
+				require.Equal(t, map[string]bool{"metrics-proxy-ctlr": true, "metrics-proxy-syncer": true}, mounts)
+			} else {
+				require.Empty(t, mounts)
+			}
+
+			// the Service ports serve HTTPS from the proxies, which forward to the plain ports
+			containers := map[string]v1.Container{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				containers[container.Name] = container
+			}
+			var service v1.Service
+			helm.UnmarshalK8SYaml(t, serviceOutput, &service)
+			require.Len(t, service.Spec.Ports, 2)
+			for _, port := range service.Spec.Ports {
+				upstream := map[string]int32{"ctlr": 2112, "syncer": 2113}[port.Name]
+				require.NotZero(t, upstream, port.Name)
+				require.Equal(t, upstream, port.Port)
+				if !tt.args.expectedMounted {
+					require.Nil(t, port.AppProtocol)
+					require.Equal(t, intstr.FromInt32(upstream), port.TargetPort)
+					require.NotContains(t, containers, "metrics-proxy-"+port.Name)
+					continue
+				}
+				require.NotNil(t, port.AppProtocol)
+				require.Equal(t, "https", *port.AppProtocol)
+				require.Equal(t, intstr.FromString(port.Name+"-https"), port.TargetPort)
+				proxy, ok := containers["metrics-proxy-"+port.Name]
+				require.True(t, ok, port.Name)
+				require.Len(t, proxy.Ports, 1)
+				require.Equal(t, port.TargetPort.StrVal, proxy.Ports[0].Name)
+				require.Subset(t, proxy.Args, []string{
+					fmt.Sprintf("--secure-listen-address=:%d", proxy.Ports[0].ContainerPort),
+					fmt.Sprintf("--upstream=http://127.0.0.1:%d/", upstream),
+					"--tls-cert-file=/etc/vsphere-csi/tls/tls.crt",
+					"--tls-private-key-file=/etc/vsphere-csi/tls/tls.key",
+				})
+				require.Equal(t, "rancher/mirrored-brancz-kube-rbac-proxy:v0.18.2", proxy.Image)
+			}
+
+			// the plain ports are only published, and admitted by the NetworkPolicy, without TLS
+			published := map[string]int32{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				for _, port := range container.Ports {
+					published[container.Name+"/"+port.Name] = port.ContainerPort
+				}
+			}
+			if !tt.args.expectedMounted {
+				require.Equal(t, int32(2112), published["vsphere-csi-controller/prometheus"])
+				require.Equal(t, int32(2113), published["vsphere-syncer/prometheus"])
+				require.Error(t, networkPolicyErr)
+			} else {
+				require.NotContains(t, slices.Collect(maps.Values(published)), int32(2112))
+				require.NotContains(t, slices.Collect(maps.Values(published)), int32(2113))
+				require.NoError(t, networkPolicyErr)
+				var networkPolicy networkingv1.NetworkPolicy
+				helm.UnmarshalK8SYaml(t, networkPolicyOutput, &networkPolicy)
+				require.Equal(t, deployment.Spec.Template.Labels["app"], networkPolicy.Spec.PodSelector.MatchLabels["app"])
+				require.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, networkPolicy.Spec.PolicyTypes)
+				require.Len(t, networkPolicy.Spec.Ingress, 1)
+				require.Empty(t, networkPolicy.Spec.Ingress[0].From)
+				var admitted []string
+				for _, port := range networkPolicy.Spec.Ingress[0].Ports {
+					admitted = append(admitted, port.Port.StrVal)
+				}
+				require.ElementsMatch(t, []string{"healthz", "ctlr-https", "syncer-https"}, admitted)
+				for _, name := range []string{"vsphere-csi-controller/healthz", "metrics-proxy-ctlr/ctlr-https", "metrics-proxy-syncer/syncer-https"} {
+					require.Contains(t, published, name)
+				}
+			}
+
+			if tt.args.expectedKind == "" {
+				require.Error(t, certificateErr)
+			} else {
+				require.NoError(t, certificateErr)
+				var object map[string]interface{}
+				helm.UnmarshalK8SYaml(t, certificateOutput, &object)
+				require.Equal(t, tt.args.expectedKind, object["kind"])
+				if tt.args.expectedKind == "Secret" {
+					var secret v1.Secret
+					helm.UnmarshalK8SYaml(t, certificateOutput, &secret)
+					require.Equal(t, "vsphere-csi-controller-metrics-tls", secret.Name)
+					require.NotEmpty(t, secret.Data["ca.crt"])
+					require.NotEmpty(t, secret.Data["tls.crt"])
+					require.NotEmpty(t, secret.Data["tls.key"])
+				} else {
+					spec := object["spec"].(map[string]interface{})
+					require.Equal(t, "vsphere-csi-controller-metrics-tls", spec["secretName"])
+					require.Contains(t, spec["dnsNames"], "vsphere-csi-controller."+tt.args.namespace+".svc")
+				}
+			}
+
+			if tt.args.expectedIssuerRender {
+				require.NoError(t, issuerErr)
+			} else {
+				require.Error(t, issuerErr)
+			}
+		})
+	}
+}
+
+func TestCSITemplateRenderedConfigSecret(t *testing.T) {
+	type args struct {
+		values                        func(*values.CSI)
+		password                      string
+		expectedDatacenters           string
+		expectedMigrationDatastoreURL string
+		expectedTopologyCategories    string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Plain password",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            "test",
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Password with quotes",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            `pa"ss'word"`,
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Password with backslashes",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            `pass\word\"\`,
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Password with comment characters",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            "pass;word#1 ; # ",
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Unicode password",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            "pässwörd\u00a0密码\u200b",
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Password with control characters",
+			args: args{
+				values:              func(*values.CSI) {},
+				password:            "pass\tword\n\a",
+				expectedDatacenters: "DC0",
+			},
+		},
+		{
+			name: "Several datacenters with topology and migration",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VCenter.Datacenters = `DC0,"DC 1",Zürich`
+					v.VCenter.Labels.TopologyCategories = "k8s-region,k8s-zone"
+					v.CSIMigration.Enabled = true
+					v.CSIMigration.MigrationDatastoreURL = "ds:///vmfs/volumes/vsan:52cdfa80721ff516-ea1e993113acfc77/"
+				},
+				password:                      "test",
+				expectedDatacenters:           `DC0,"DC 1",Zürich`,
+				expectedMigrationDatastoreURL: "ds:///vmfs/volumes/vsan:52cdfa80721ff516-ea1e993113acfc77/",
+				expectedTopologyCategories:    "k8s-region,k8s-zone",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+
+			namespace := "csitest-" + strings.ToLower(random.UniqueId())
+			releaseName := "csitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				ValuesFiles: []string{csiValuesFile(t, chartPath, func(v *values.CSI) {
+					v.VCenter.ClusterID = "cluster-1"
+					v.VCenter.Host = "vcenter.example.com"
+					v.VCenter.Username = "administrator@vsphere.local"
+					v.VCenter.Password = tt.args.password
+					v.VCenter.Datacenters = "DC0"
+					tt.args.values(v)
+				})},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/secret.yaml"}, "--kube-version", "1.36")
+			cfg := csiConfig(t, output)
+
+			// assert
+			require.Equal(t, "cluster-1", cfg.Global.ClusterID)
+			require.Equal(t, "administrator@vsphere.local", cfg.Global.User)
+			require.Equal(t, tt.args.password, cfg.Global.Password)
+			require.Equal(t, "443", cfg.Global.VCenterPort)
+			require.True(t, cfg.Global.InsecureFlag)
+			require.Len(t, cfg.VirtualCenter, 1)
+			require.Contains(t, cfg.VirtualCenter, "vcenter.example.com")
+			require.Equal(t, tt.args.expectedDatacenters, cfg.VirtualCenter["vcenter.example.com"].Datacenters)
+			require.Equal(t, tt.args.expectedMigrationDatastoreURL, cfg.VirtualCenter["vcenter.example.com"].MigrationDataStoreURL)
+			require.Equal(t, tt.args.expectedTopologyCategories, cfg.Labels.TopologyCategories)
+		})
+	}
+}
+
+func TestCSITemplateRenderedConfigSecretInvalidPassword(t *testing.T) {
+	// arrange
+	chartPath, err := filepath.Abs(csiChart)
+	require.NoError(t, err)
+
+	namespace := "csitest-" + strings.ToLower(random.UniqueId())
+	releaseName := "csitest-" + strings.ToLower(random.UniqueId())
+	options := &helm.Options{
+		ValuesFiles: []string{csiValuesFile(t, chartPath, func(v *values.CSI) {
+			v.VCenter.Password = "pass\r\nword"
+		})},
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+	}
+
+	// act
+	_, err = helm.RenderTemplateE(t, options, chartPath, releaseName, []string{"templates/secret.yaml"}, "--kube-version", "1.36")
+
+	// assert
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "csi-vsphere.conf values cannot contain carriage return or NUL characters")
+}
+
+func TestCSITemplateRenderedFeatureStates(t *testing.T) {
+	enabled, disabled := true, false
+	defaults := map[string]string{
+		"csi-migration":                     "false",
+		"csi-auth-check":                    "true",
+		"online-volume-extend":              "false",
+		"trigger-csi-fullsync":              "false",
+		"async-query-volume":                "false",
+		"improved-csi-idempotency":          "false",
+		"improved-volume-topology":          "false",
+		"block-volume-snapshot":             "false",
+		"csi-windows-support":               "false",
+		"use-csinode-id":                    "true",
+		"list-volumes":                      "false",
+		"pv-to-backingdiskobjectid-mapping": "false",
+		"cnsmgr-suspend-create-volume":      "false",
+		"topology-preferential-datastores":  "false",
+		"max-pvscsi-targets-per-vm":         "false",
+		"multi-vcenter-csi-topology":        "true",
+		"csi-internal-generated-cluster-id": "false",
+	}
+	versionDefaults := values.VersionOverride[values.CSIOverrides]{
+		Constraint: ">= 1.31 < 1.37",
+		Values: values.CSIOverrides{
+			TopologyPreferentialDatastores: &values.FeatureOverride{Enabled: &enabled},
+			FeatureStates:                  map[string]bool{"fss-new-feature": false},
+		},
+	}
+	type args struct {
+		values      func(*values.CSI)
+		kubeVersion string
+		// expectedChanges are the feature states that differ from the defaults
+		expectedChanges map[string]string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Defaults on Kubernetes 1.27",
+			args: args{
+				values:      func(*values.CSI) {},
+				kubeVersion: "1.27",
+			},
+		},
+		{
+			name: "Defaults on Kubernetes 1.30",
+			args: args{
+				values:      func(*values.CSI) {},
+				kubeVersion: "1.30",
+			},
+		},
+		{
+			name: "Defaults on Kubernetes 1.36",
+			args: args{
+				values:      func(*values.CSI) {},
+				kubeVersion: "1.36",
+			},
+		},
+		{
+			name: "Defaults on an unsupported Kubernetes version",
+			args: args{
+				values: func(v *values.CSI) {
+					v.AllowUnsupportedKubeVersion = true
+				},
+				kubeVersion: "1.37",
+			},
+		},
+		{
+			name: "Toggles",
+			args: args{
+				values: func(v *values.CSI) {
+					v.ListVolumes.Enabled = &enabled
+					v.PVToBackingDiskObjectIDMapping.Enabled = &disabled
+					v.CSIAuthCheck.Enabled = false
+				},
+				kubeVersion:     "1.36",
+				expectedChanges: map[string]string{"list-volumes": "true", "csi-auth-check": "false"},
+			},
+		},
+		{
+			name: "Feature states override toggles",
+			args: args{
+				values: func(v *values.CSI) {
+					v.ListVolumes.Enabled = &enabled
+					v.FeatureStates = map[string]bool{"list-volumes": false, "csi-auth-check": false, "async-query-volume": true}
+				},
+				kubeVersion:     "1.30",
+				expectedChanges: map[string]string{"list-volumes": "false", "csi-auth-check": "false", "async-query-volume": "true"},
+			},
+		},
+		{
+			name: "Feature states extend the built-in feature states",
+			args: args{
+				values: func(v *values.CSI) {
+					v.FeatureStates = map[string]bool{"fss-new-feature": true}
+				},
+				kubeVersion:     "1.27",
+				expectedChanges: map[string]string{"fss-new-feature": "true"},
+			},
+		},
+		{
+			name: "Version defaults on a matching Kubernetes version",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults)
+				},
+				kubeVersion:     "1.36",
+				expectedChanges: map[string]string{"topology-preferential-datastores": "true", "fss-new-feature": "false"},
+			},
+		},
+		{
+			name: "Version defaults on another Kubernetes version",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults)
+				},
+				kubeVersion: "1.30",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+
+			namespace := "csitest-" + strings.ToLower(random.UniqueId())
+			releaseName := "csitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				ValuesFiles:    []string{csiValuesFile(t, chartPath, tt.args.values)},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+			expected := maps.Clone(defaults)
+			maps.Copy(expected, tt.args.expectedChanges)
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/configmap.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var configMap v1.ConfigMap
+			helm.UnmarshalK8SYaml(t, output, &configMap)
+
+			// assert
+			require.Equal(t, "internal-feature-states.csi.vsphere.vmware.com", configMap.Name)
+			require.Equal(t, namespace, configMap.Namespace)
+			require.Equal(t, expected, configMap.Data)
+		})
+	}
+}
+
+// TestCSITemplateRenderedVersionOverridesPrecedence checks that versionOverrides only fill
+// in the values left unset, so that the values set by the user always win.
+func TestCSITemplateRenderedVersionOverridesPrecedence(t *testing.T) {
+	enabled, disabled := true, false
+	versionDefaults := []values.VersionOverride[values.CSIOverrides]{
+		{
+			Constraint: ">= 1.31 < 1.37",
+			Values: values.CSIOverrides{
+				CSIController: &values.CSIControllerOverrides{
+					CSIResizer: &values.FeatureOverride{Enabled: &enabled},
+				},
+				ListVolumes:   &values.FeatureOverride{Enabled: &enabled},
+				FeatureStates: map[string]bool{"topology-preferential-datastores": true, "fss-new-feature": true},
+			},
+		},
+		{
+			Constraint: ">= 1.36",
+			Values: values.CSIOverrides{
+				ListVolumes:   &values.FeatureOverride{Enabled: &disabled},
+				FeatureStates: map[string]bool{"fss-new-feature": false},
+			},
+		},
+	}
+	type args struct {
+		// values are applied to the chart values, nil renders the chart defaults
+		values      func(*values.CSI)
+		kubeVersion string
+		// expectedFeatureStates are some of the rendered feature states
+		expectedFeatureStates map[string]string
+		expectedResizer       bool
+		expectedDriverImage   string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Chart defaults on Kubernetes 1.35",
+			args: args{
+				kubeVersion: "1.35",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                      "false",
+					"pv-to-backingdiskobjectid-mapping": "false",
+					"topology-preferential-datastores":  "false",
+				},
+				expectedResizer:     false,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+			},
+		},
+		{
+			name: "Chart defaults on Kubernetes 1.27",
+			args: args{
+				kubeVersion: "1.27",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                      "false",
+					"pv-to-backingdiskobjectid-mapping": "false",
+					"topology-preferential-datastores":  "false",
+				},
+				expectedResizer:     false,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.2.0",
+			},
+		},
+		{
+			name: "Version defaults fill the unset values",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults...)
+				},
+				kubeVersion: "1.35",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                     "true",
+					"topology-preferential-datastores": "true",
+					"fss-new-feature":                  "true",
+				},
+				expectedResizer:     true,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+			},
+		},
+		{
+			name: "Later version defaults take precedence",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults...)
+				},
+				kubeVersion: "1.36",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                     "false",
+					"topology-preferential-datastores": "true",
+					"fss-new-feature":                  "false",
+				},
+				expectedResizer:     true,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+			},
+		},
+		{
+			name: "User values win over version defaults",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults...)
+					v.CSIController.CSIResizer.Enabled = &disabled
+					v.ListVolumes.Enabled = &disabled
+					v.FeatureStates = map[string]bool{"topology-preferential-datastores": false}
+					v.CSIController.Image.Tag = "v3.3.1"
+				},
+				kubeVersion: "1.35",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                     "false",
+					"topology-preferential-datastores": "false",
+					"fss-new-feature":                  "true",
+				},
+				expectedResizer:     false,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
+			},
+		},
+		{
+			name: "No version defaults on other Kubernetes versions",
+			args: args{
+				values: func(v *values.CSI) {
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults...)
+				},
+				kubeVersion: "1.30",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                     "false",
+					"topology-preferential-datastores": "false",
+				},
+				expectedResizer:     false,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.3.1",
+			},
+		},
+		{
+			name: "No version defaults on an unsupported Kubernetes version",
+			args: args{
+				values: func(v *values.CSI) {
+					v.AllowUnsupportedKubeVersion = true
+					v.VersionOverrides = append(v.VersionOverrides, versionDefaults...)
+				},
+				kubeVersion: "1.38",
+				expectedFeatureStates: map[string]string{
+					"list-volumes":                     "false",
+					"topology-preferential-datastores": "false",
+				},
+				expectedResizer:     false,
+				expectedDriverImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:latest",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+
+			namespace := "csitest-" + strings.ToLower(random.UniqueId())
+			releaseName := "csitest-" + strings.ToLower(random.UniqueId())
+			options := &helm.Options{
+				SetValues:      map[string]string{"vCenter.clusterId": random.UniqueId()},
+				KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+			}
+			if tt.args.values != nil {
+				options.ValuesFiles = []string{csiValuesFile(t, chartPath, tt.args.values)}
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, releaseName, []string{"templates/configmap.yaml", "templates/controller/deployment.yaml"}, "--kube-version", tt.args.kubeVersion)
+
+			var configMap v1.ConfigMap
+			var deployment appsv1.Deployment
+			for _, manifest := range splitManifests(output) {
+				switch {
+				case strings.Contains(manifest, "kind: ConfigMap"):
+					helm.UnmarshalK8SYaml(t, manifest, &configMap)
+				case strings.Contains(manifest, "kind: Deployment"):
+					helm.UnmarshalK8SYaml(t, manifest, &deployment)
+				}
+			}
+
+			// assert
+			for name, state := range tt.args.expectedFeatureStates {
+				require.Equal(t, state, configMap.Data[name], name)
+			}
+			containers := map[string]string{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				containers[container.Name] = container.Image
+			}
+			require.Contains(t, containers, "vsphere-csi-controller")
+			require.Equal(t, tt.args.expectedDriverImage, containers["vsphere-csi-controller"])
+			_, resizer := containers["csi-resizer"]
+			require.Equal(t, tt.args.expectedResizer, resizer)
+		})
+	}
+}
+
+func TestCSITemplateRenderedProxy(t *testing.T) {
+	type args struct {
+		values           map[string]string
+		expectedProxyEnv map[string]map[string]string
+	}
+	noProxyEnv := map[string]map[string]string{
+		"csi-attacher":           {},
+		"vsphere-csi-controller": {},
+		"liveness-probe":         {},
+		"vsphere-syncer":         {},
+		"csi-provisioner":        {},
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "No proxy",
+			args: args{
+				values:           map[string]string{"global.proxy.noProxy": "vcenter.example.com"},
+				expectedProxyEnv: noProxyEnv,
+			},
+		},
+		{
+			name: "HTTP and HTTPS proxy",
+			args: args{
+				values: map[string]string{
+					"global.proxy.httpProxy":  "http://proxy.example.com:3128",
+					"global.proxy.httpsProxy": "http://proxy.example.com:3128",
+					"global.proxy.noProxy":    "vcenter.example.com",
+				},
+				expectedProxyEnv: map[string]map[string]string{
+					"csi-attacher": {},
+					"vsphere-csi-controller": {
+						"HTTP_PROXY":  "http://proxy.example.com:3128",
+						"HTTPS_PROXY": "http://proxy.example.com:3128",
+						"NO_PROXY":    "vcenter.example.com,127.0.0.1,localhost,.svc,.cluster.local,10.43.0.0/16",
+					},
+					"liveness-probe": {},
+					"vsphere-syncer": {
+						"HTTP_PROXY":  "http://proxy.example.com:3128",
+						"HTTPS_PROXY": "http://proxy.example.com:3128",
+						"NO_PROXY":    "vcenter.example.com,127.0.0.1,localhost,.svc,.cluster.local,10.43.0.0/16",
+					},
+					"csi-provisioner": {},
+				},
+			},
+		},
+		{
+			name: "HTTPS proxy with a service CIDR",
+			args: args{
+				values: map[string]string{
+					"global.proxy.httpsProxy":  "http://proxy.example.com:3128",
+					"global.proxy.serviceCidr": "10.45.0.0/16",
+				},
+				expectedProxyEnv: map[string]map[string]string{
+					"csi-attacher": {},
+					"vsphere-csi-controller": {
+						"HTTPS_PROXY": "http://proxy.example.com:3128",
+						"NO_PROXY":    "127.0.0.1,localhost,.svc,.cluster.local,10.45.0.0/16",
+					},
+					"liveness-probe": {},
+					"vsphere-syncer": {
+						"HTTPS_PROXY": "http://proxy.example.com:3128",
+						"NO_PROXY":    "127.0.0.1,localhost,.svc,.cluster.local,10.45.0.0/16",
+					},
+					"csi-provisioner": {},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+
+			values := map[string]string{"vCenter.clusterId": random.UniqueId()}
+			maps.Copy(values, tt.args.values)
+			options := &helm.Options{
+				SetValues:      values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", "csitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "csitest", []string{"templates/controller/deployment.yaml"}, "--kube-version", "1.36")
+
+			// assert
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, output, &deployment)
+			actual := map[string]map[string]string{}
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				actual[container.Name] = proxyEnv(container)
+			}
+			require.Equal(t, tt.args.expectedProxyEnv, actual)
+		})
+	}
+}
+
+func TestCSITemplateRenderedTestPod(t *testing.T) {
+	type args struct {
+		values map[string]string
+		// expectedSecret is empty when no test pod is rendered
+		expectedSecret   string
+		expectedRendered bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Generated config",
+			args: args{
+				values:           map[string]string{},
+				expectedSecret:   "vsphere-config-secret",
+				expectedRendered: true,
+			},
+		},
+		{
+			name: "Generated config with a custom name",
+			args: args{
+				values:           map[string]string{"vCenter.configSecret.name": "csi-config"},
+				expectedSecret:   "csi-config",
+				expectedRendered: true,
+			},
+		},
+		{
+			name: "Existing config",
+			args: args{
+				values: map[string]string{
+					"vCenter.configSecret.generate": "false",
+					"vCenter.configSecret.name":     "csi-config",
+				},
+				expectedSecret:   "csi-config",
+				expectedRendered: false,
+			},
+		},
+		{
+			name: "Tests disabled",
+			args: args{
+				values:           map[string]string{"tests.enabled": "false"},
+				expectedSecret:   "",
+				expectedRendered: false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+
+			values := map[string]string{
+				"vCenter.clusterId":   random.UniqueId(),
+				"vCenter.host":        "vcenter.example.com",
+				"vCenter.datacenters": "DC0",
+				"vCenter.username":    "administrator@vsphere.local",
+				"vCenter.password":    random.UniqueId(),
+			}
+			maps.Copy(values, tt.args.values)
+			options := &helm.Options{
+				SetValues:      values,
+				KubectlOptions: k8s.NewKubectlOptions("", "", "csitest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output := helm.RenderTemplate(t, options, chartPath, "csitest", nil, "--kube-version", "1.36")
+
+			// assert
+			var pod *v1.Pod
+			rendered := map[string]bool{}
+			for _, manifest := range splitManifests(output) {
+				var object struct {
+					Kind     string `json:"kind"`
+					Metadata struct {
+						Name string `json:"name"`
+					} `json:"metadata"`
+				}
+				helm.UnmarshalK8SYaml(t, manifest, &object)
+				rendered[object.Kind+"/"+object.Metadata.Name] = true
+				if object.Kind == "Pod" {
+					pod = &v1.Pod{}
+					helm.UnmarshalK8SYaml(t, manifest, pod)
+				}
+			}
+			if tt.args.expectedSecret == "" {
+				require.Nil(t, pod)
+				return
+			}
+			require.NotNil(t, pod)
+			require.Equal(t, "test", pod.Annotations["helm.sh/hook"])
+			require.Equal(t, v1.RestartPolicyNever, pod.Spec.RestartPolicy)
+			require.Len(t, pod.Spec.Containers, 1)
+			container := pod.Spec.Containers[0]
+			require.Equal(t, []v1.EnvVar{
+				{Name: "CONFIG_FORMAT", Value: "csi"},
+				{Name: "CONFIG_FILE", Value: "/etc/cloud/csi-vsphere.conf"},
+			}, container.Env)
+			require.Contains(t, container.Command[len(container.Command)-1], "FindByInventoryPath")
+			require.Equal(t, []v1.VolumeMount{{Name: "vsphere-config-volume", MountPath: "/etc/cloud", ReadOnly: true}}, container.VolumeMounts)
+			require.Len(t, pod.Spec.Volumes, 1)
+			require.NotNil(t, pod.Spec.Volumes[0].Secret)
+			require.Equal(t, tt.args.expectedSecret, pod.Spec.Volumes[0].Secret.SecretName)
+			require.Equal(t, tt.args.expectedRendered, rendered["Secret/"+tt.args.expectedSecret])
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/values"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gcfg.v1"
+	yamlv2 "gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	ccmconfig "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphere/config"
+	lbconfig "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphere/loadbalancer/config"
+	routeconfig "k8s.io/cloud-provider-vsphere/pkg/cloudprovider/vsphere/route/config"
+	cpiconfig "k8s.io/cloud-provider-vsphere/pkg/common/config"
+	nsxtconfig "k8s.io/cloud-provider-vsphere/pkg/nsxt/config"
+	csiconfig "sigs.k8s.io/vsphere-csi-driver/v3/pkg/common/config"
+)
+
+// requiredNodeSelectorKeys flattens the required node affinity of a pod into the
+// match expression keys of each node selector term.
+func requiredNodeSelectorKeys(affinity *v1.Affinity) [][]string {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+	var terms [][]string
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		var keys []string
+		for _, expression := range term.MatchExpressions {
+			keys = append(keys, expression.Key)
+		}
+		terms = append(terms, keys)
+	}
+	return terms
+}
+
+// tolerationKeys returns the keys of the given tolerations in order.
+func tolerationKeys(tolerations []v1.Toleration) []string {
+	var keys []string
+	for _, toleration := range tolerations {
+		keys = append(keys, toleration.Key)
+	}
+	return keys
+}
+
+// splitManifests splits a multi-document render into its non-empty documents.
+func splitManifests(output string) []string {
+	var manifests []string
+	for _, manifest := range strings.Split(output, "\n---\n") {
+		if strings.TrimSpace(strings.TrimPrefix(manifest, "---")) != "" {
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests
+}
+
+// cpiValuesFile writes the default values of the CPI chart at chartPath, changed by
+// mutate, to a values file and returns its path.
+func cpiValuesFile(t *testing.T, chartPath string, mutate func(*values.CPI)) string {
+	v, err := values.LoadCPIChart(chartPath)
+	require.NoError(t, err)
+	mutate(v)
+	require.NoError(t, v.Validate())
+
+	path := filepath.Join(t.TempDir(), "values.yaml")
+	require.NoError(t, v.WriteFile(path))
+	return path
+}
+
+// csiValuesFile writes the default values of the CSI chart at chartPath, changed by
+// mutate, to a values file and returns its path. A random cluster ID is set first as the
+// chart requires one.
+func csiValuesFile(t *testing.T, chartPath string, mutate func(*values.CSI)) string {
+	v, err := values.LoadCSIChart(chartPath)
+	require.NoError(t, err)
+	v.VCenter.ClusterID = random.UniqueId()
+	mutate(v)
+	require.NoError(t, v.Validate())
+
+	path := filepath.Join(t.TempDir(), "values.yaml")
+	require.NoError(t, v.WriteFile(path))
+	return path
+}
+
+// csiConfig decodes csi-vsphere.conf from the rendered config Secret and parses it into
+// the config of the CSI driver with gcfg, as the driver does. Variables the driver does
+// not know fail the parsing.
+func csiConfig(t *testing.T, output string) *csiconfig.Config {
+	var secret v1.Secret
+	helm.UnmarshalK8SYaml(t, output, &secret)
+	require.Contains(t, secret.Data, "csi-vsphere.conf")
+
+	cfg := &csiconfig.Config{}
+	require.NoError(t, gcfg.ReadStringInto(cfg, string(secret.Data["csi-vsphere.conf"])))
+	return cfg
+}
+
+// cpiConfig parses vsphere.yaml from the rendered cloud config ConfigMap into the config
+// of the CPI, validating it as the CPI does.
+func cpiConfig(t *testing.T, output string) *cpiconfig.CommonConfigYAML {
+	var configMap v1.ConfigMap
+	helm.UnmarshalK8SYaml(t, output, &configMap)
+	require.Contains(t, configMap.Data, "vsphere.yaml")
+
+	cfg, err := cpiconfig.ReadRawConfigYAML([]byte(configMap.Data["vsphere.yaml"]))
+	require.NoError(t, err)
+	return cfg
+}
+
+// cpiCloudConfig is vsphere.yaml as read by the cloud controller manager: the common
+// config, the nodes and the NSX-T manager, load balancer and route sections.
+type cpiCloudConfig struct {
+	Global                      cpiconfig.GlobalYAML                          `yaml:"global"`
+	Vcenter                     map[string]*cpiconfig.VirtualCenterConfigYAML `yaml:"vcenter"`
+	Labels                      cpiconfig.LabelsYAML                          `yaml:"labels"`
+	Nodes                       ccmconfig.NodesYAML                           `yaml:"nodes"`
+	lbconfig.LBConfigYAML       `yaml:",inline"`
+	routeconfig.RouteConfigYAML `yaml:",inline"`
+	nsxtconfig.NsxtConfigYAML   `yaml:",inline"`
+}
+
+// cpiCloudConfigRoundTrip strictly decodes vsphere.yaml from the rendered cloud config
+// ConfigMap into the upstream config structs, so keys the CPI does not know fail, and
+// checks that encoding and decoding them again gives the same config. The CPI and load
+// balancer readers, and the NSX-T one when the section is rendered, must accept the
+// rendered file as well. The encodings are compared, as
+// the decoder turns the empty lists of the encoding into empty rather than nil slices.
+func cpiCloudConfigRoundTrip(t *testing.T, output string) *cpiCloudConfig {
+	var configMap v1.ConfigMap
+	helm.UnmarshalK8SYaml(t, output, &configMap)
+	require.Contains(t, configMap.Data, "vsphere.yaml")
+	data := []byte(configMap.Data["vsphere.yaml"])
+
+	_, err := ccmconfig.ReadCPIConfigYAML(data)
+	require.NoError(t, err)
+	_, err = lbconfig.ReadRawConfigYAML(data)
+	require.NoError(t, err)
+
+	cfg := &cpiCloudConfig{}
+	require.NoError(t, yamlv2.UnmarshalStrict(data, cfg))
+	if cfg.NSXT.Host != "" {
+		_, err = nsxtconfig.ReadRawConfigYAML(data)
+		require.NoError(t, err)
+	}
+	encoded, err := yamlv2.Marshal(cfg)
+	require.NoError(t, err)
+	decoded := &cpiCloudConfig{}
+	require.NoError(t, yamlv2.UnmarshalStrict(encoded, decoded))
+	reencoded, err := yamlv2.Marshal(decoded)
+	require.NoError(t, err)
+	require.Equal(t, string(encoded), string(reencoded))
+	return cfg
+}
+
+// proxyEnv returns the proxy environment variables of a container by name.
+func proxyEnv(container v1.Container) map[string]string {
+	env := map[string]string{}
+	for _, e := range container.Env {
+		switch e.Name {
+		case "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY":
+			env[e.Name] = e.Value
+		}
+	}
+	return env
+}
+
+// renderNotes renders the NOTES.txt of the chart at chartPath, which helm template leaves
+// out, by rendering a copy of the chart with NOTES.txt wrapped in a ConfigMap template.
+func renderNotes(t *testing.T, options *helm.Options, chartPath string, extraArgs ...string) (string, error) {
+	dir := filepath.Join(t.TempDir(), filepath.Base(chartPath))
+	require.NoError(t, os.CopyFS(dir, os.DirFS(chartPath)))
+	notes, err := os.ReadFile(filepath.Join(dir, "templates", "NOTES.txt"))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "templates", "NOTES.txt")))
+	wrapper := `{{- define "notesTest" }}` + string(notes) + "{{- end }}\n" +
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: notes\ndata:\n  NOTES.txt: {{ include \"notesTest\" . | quote }}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "notes-test.yaml"), []byte(wrapper), 0o600))
+
+	output, err := helm.RenderTemplateE(t, options, dir, "notestest", []string{"templates/notes-test.yaml"}, extraArgs...)
+	if err != nil {
+		return "", err
+	}
+	var configMap v1.ConfigMap
+	helm.UnmarshalK8SYaml(t, output, &configMap)
+	return configMap.Data["NOTES.txt"], nil
+}
@@ -0,0 +1,281 @@
+package unit
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/lint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChartsLint renders the charts for every supported Kubernetes minor and checks the
+// manifests against the rules of pkg/lint.
+func TestChartsLint(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		values       map[string]string
+		hardened     bool
+		// ignoredRules lists by object the rules expected to be violated, as the
+		// lint-ignore annotation would, without annotating the chart's manifests.
+		ignoredRules map[string][]string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{},
+			},
+		},
+		{
+			name: "CPI Prime",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{"global.prime.enabled": "true"},
+				// no hardened image is pinned before Kubernetes 1.33, so Prime uses the latest one
+				ignoredRules: map[string][]string{
+					"DaemonSet/rancher-vsphere-cpi-cloud-controller-manager":  {"image-tag"},
+					"Deployment/rancher-vsphere-cpi-cloud-controller-manager": {"image-tag"},
+				},
+			},
+		},
+		{
+			name: "CPI hardened",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       withResources(map[string]string{}, "cloudControllerManager", "tests"),
+				hardened:     true,
+			},
+		},
+		{
+			name: "CSI",
+			args: args{
+				chartRelPath: csiChart,
+				values:       csiAllFeaturesValues(),
+			},
+		},
+		{
+			name: "CSI Prime",
+			args: args{
+				chartRelPath: csiChart,
+				values:       withValues(csiAllFeaturesValues(), map[string]string{"global.prime.enabled": "true"}),
+			},
+		},
+		{
+			name: "CSI hardened with prefix paths",
+			args: args{
+				chartRelPath: csiChart,
+				values: withResources(withValues(csiAllFeaturesValues(), map[string]string{
+					"csiNode.prefixPath":        "/rootfs",
+					"csiNode.prefixPathWindows": `C:\rootfs`,
+				}), csiResourcesPaths()...),
+				hardened: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		chartPath, err := filepath.Abs(tt.args.chartRelPath)
+		require.NoError(t, err)
+
+		for _, kubeVersion := range supportedMinors(t, chartPath) {
+			t.Run(tt.name+" "+kubeVersion, func(t *testing.T) {
+				// arrange
+				options := &helm.Options{
+					SetValues:      tt.args.values,
+					KubectlOptions: k8s.NewKubectlOptions("", "", "linttest-"+strings.ToLower(random.UniqueId())),
+				}
+				output := helm.RenderTemplate(t, options, chartPath, "linttest", nil, "--kube-version", kubeVersion)
+
+				// act
+				findings, err := lint.Lint(output, lint.Options{Hardened: tt.args.hardened})
+
+				// assert
+				require.NoError(t, err)
+				for _, finding := range findings {
+					if !slices.Contains(tt.args.ignoredRules[finding.Object], finding.Rule) {
+						t.Error(finding)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLintRules(t *testing.T) {
+	const labels = `    app.kubernetes.io/version: "1"
+    app.kubernetes.io/managed-by: Helm
+    helm.sh/chart: chart-1
+`
+	type args struct {
+		manifests        string
+		hardened         bool
+		expectedFindings []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Compliant workload",
+			args: args{
+				manifests:        "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", labels, "image: example:v1\n", ""),
+				expectedFindings: nil,
+			},
+		},
+		{
+			name: "Latest tag",
+			args: args{
+				manifests:        "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", labels, "image: example:latest\n", ""),
+				expectedFindings: []string{`chart/templates/deployment.yaml:24: Deployment/example: image "example:latest" of container "example" is not pinned to a tag (image-tag)`},
+			},
+		},
+		{
+			name: "Missing labels",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", "    app: example\n", "image: example:v1\n", ""),
+				expectedFindings: []string{
+					`chart/templates/deployment.yaml:8: Deployment/example: Deployment has no app.kubernetes.io/version label, include the labels helper (workload-labels)`,
+					`chart/templates/deployment.yaml:8: Deployment/example: Deployment has no app.kubernetes.io/managed-by label, include the labels helper (workload-labels)`,
+					`chart/templates/deployment.yaml:8: Deployment/example: Deployment has no helm.sh/chart label, include the labels helper (workload-labels)`,
+					`chart/templates/deployment.yaml:16: Deployment/example: pod template has no app.kubernetes.io/version label, include the labels helper (workload-labels)`,
+					`chart/templates/deployment.yaml:16: Deployment/example: pod template has no app.kubernetes.io/managed-by label, include the labels helper (workload-labels)`,
+					`chart/templates/deployment.yaml:16: Deployment/example: pod template has no helm.sh/chart label, include the labels helper (workload-labels)`,
+				},
+			},
+		},
+		{
+			name: "Missing resources when hardened",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", labels, "image: example:v1\n", ""),
+				hardened:  true,
+				expectedFindings: []string{
+					`chart/templates/deployment.yaml:23: Deployment/example: container "example" has no resource requests (container-resources)`,
+					`chart/templates/deployment.yaml:23: Deployment/example: container "example" has no resource limits (container-resources)`,
+				},
+			},
+		},
+		{
+			name: "Unknown host path and privileged container",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", labels,
+					"image: example:v1\n          securityContext:\n            privileged: true\n",
+					"      volumes:\n        - name: root\n          hostPath:\n            path: /\n"),
+				expectedFindings: []string{
+					`chart/templates/deployment.yaml:30: Deployment/example: volume "root" mounts host path "/", which is not a CSI node plugin path (host-path)`,
+					`chart/templates/deployment.yaml:26: Deployment/example: container "example" is privileged (privileged-container)`,
+				},
+			},
+		},
+		{
+			name: "Kubelet path of the node plugin",
+			args: args{
+				manifests: "---\n# Source: chart/templates/daemonset.yaml\n" + strings.Replace(lintDeployment("vsphere-csi-node-windows", labels, "image: example:v1\n",
+					"      volumes:\n        - name: kubelet\n          hostPath:\n            path: 'C:\\rootfs\\var\\lib\\kubelet'\n"),
+					"kind: Deployment", "kind: DaemonSet", 1),
+				expectedFindings: nil,
+			},
+		},
+		{
+			name: "Kubelet path outside the node plugin",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("example", labels, "image: example:v1\n",
+					"      volumes:\n        - name: kubelet\n          hostPath:\n            path: /rootfs/var/lib/kubelet\n"),
+				expectedFindings: []string{`chart/templates/deployment.yaml:28: Deployment/example: volume "kubelet" mounts host path "/rootfs/var/lib/kubelet", which is not a CSI node plugin path (host-path)`},
+			},
+		},
+		{
+			name: "Suppressed rules",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + strings.Replace(lintDeployment("example", labels,
+					"image: example:latest\n          securityContext:\n            privileged: true\n", ""),
+					"  labels:\n", "  annotations:\n    "+lint.IgnoreAnnotation+": image-tag, privileged-container\n  labels:\n", 1),
+				expectedFindings: nil,
+			},
+		},
+		{
+			name: "Lines counted per template",
+			args: args{
+				manifests: "---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("first", labels, "image: example:v1\n", "") +
+					"---\n# Source: chart/templates/other.yaml\nkind: ConfigMap\napiVersion: v1\nmetadata:\n  name: other\n" +
+					"---\n# Source: chart/templates/deployment.yaml\n" + lintDeployment("second", labels, "image: example\n", ""),
+				expectedFindings: []string{`chart/templates/deployment.yaml:48: Deployment/second: image "example" of container "second" is not pinned to a tag (image-tag)`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// act
+			findings, err := lint.Lint(tt.args.manifests, lint.Options{Hardened: tt.args.hardened})
+
+			// assert
+			require.NoError(t, err)
+			var actual []string
+			for _, finding := range findings {
+				actual = append(actual, finding.String())
+			}
+			require.Equal(t, tt.args.expectedFindings, actual)
+		})
+	}
+}
+
+// lintDeployment renders a Deployment with one container for the lint rule tests. The
+// image of the container is on line 24 of the template output.
+func lintDeployment(name, labels, container, volumes string) string {
+	return `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: ` + name + `
+  labels:
+` + labels + `spec:
+  selector:
+    matchLabels:
+      app: ` + name + `
+  template:
+    metadata:
+      labels:
+` + strings.ReplaceAll(labels, "    ", "        ") + `    spec:
+      containers:
+        - name: ` + name + `
+          ` + container + volumes
+}
+
+// withValues returns values with the entries of extra added.
+func withValues(values, extra map[string]string) map[string]string {
+	for key, value := range extra {
+		values[key] = value
+	}
+	return values
+}
+
+// withResources sets resource requests and limits at each of the resources paths, as
+// hardened clusters require.
+func withResources(values map[string]string, paths ...string) map[string]string {
+	for _, path := range paths {
+		values[path+".resources.requests.cpu"] = "10m"
+		values[path+".resources.requests.memory"] = "64Mi"
+		values[path+".resources.limits.memory"] = "512Mi"
+	}
+	return values
+}
+
+// csiResourcesPaths are the paths of the container resources of the CSI chart.
+func csiResourcesPaths() []string {
+	paths := []string{"tests"}
+	for _, image := range []string{"", ".csiAttacher", ".csiResizer", ".livenessProbe", ".vsphereSyncer", ".csiProvisioner", ".csiSnapshotter", ".vsphereWebhook", ".metricsProxy"} {
+		paths = append(paths, "csiController.image"+image)
+	}
+	for _, image := range []string{"", ".nodeDriverRegistrar", ".livenessProbe"} {
+		paths = append(paths, "csiNode.image"+image, "csiNodeWindows.image"+image)
+	}
+	return paths
+}
@@ -0,0 +1,163 @@
+package unit
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/rbac"
+	"github.com/stretchr/testify/require"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// TestRBACPermissionMatrix renders the charts with no feature, each feature alone and
+// every feature of the permission matrix enabled, and checks the rendered roles grant
+// exactly the permissions of the matrix.
+func TestRBACPermissionMatrix(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		values       map[string]string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       cpiNSXTValues(),
+			},
+		},
+		{
+			name: "CSI",
+			args: args{
+				chartRelPath: csiChart,
+				values:       map[string]string{"vCenter.clusterId": random.UniqueId()},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		chartPath, err := filepath.Abs(tt.args.chartRelPath)
+		require.NoError(t, err)
+		matrix, err := rbac.Load(filepath.Base(chartPath))
+		require.NoError(t, err)
+
+		features := matrix.Features()
+		profiles := map[string][]string{"no features": nil, "all features": features}
+		for _, feature := range features {
+			profiles[feature] = []string{feature}
+		}
+
+		for _, kubeVersion := range supportedMinors(t, chartPath) {
+			for profile, enabled := range profiles {
+				t.Run(tt.name+" "+kubeVersion+" "+profile, func(t *testing.T) {
+					// arrange
+					values := withValues(map[string]string{}, tt.args.values)
+					expectedFeatures := map[string]bool{}
+					for _, feature := range features {
+						on := slices.Contains(enabled, feature)
+						values[feature] = strconv.FormatBool(on)
+						expectedFeatures[feature] = on
+					}
+					options := &helm.Options{
+						SetValues:      values,
+						KubectlOptions: k8s.NewKubectlOptions("", "", "rbactest-"+strings.ToLower(random.UniqueId())),
+					}
+					output := helm.RenderTemplate(t, options, chartPath, "rbactest", nil, "--kube-version", kubeVersion)
+
+					// act
+					rendered, err := rbac.Rendered(output)
+
+					// assert
+					require.NoError(t, err)
+					for _, difference := range rbac.Diff(matrix.Expected(expectedFeatures), rendered) {
+						t.Error(difference)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestRBACDiff(t *testing.T) {
+	const role = "ClusterRole/example"
+	rules := []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get", "list"}},
+		{APIGroups: []string{"storage.k8s.io"}, Resources: []string{"csinodes"}, Verbs: []string{"get"}},
+	}
+	type args struct {
+		rendered     []rbacv1.PolicyRule
+		otherRole    bool
+		expectedDiff []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Rules expanded into permissions",
+			args: args{
+				rendered: []rbacv1.PolicyRule{
+					{APIGroups: []string{"", "storage.k8s.io"}, Resources: []string{"nodes", "csinodes"}, Verbs: []string{"get"}},
+					{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"list"}},
+					{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}},
+				},
+				expectedDiff: []string{
+					"ClusterRole/example: widened with get csinodes",
+					"ClusterRole/example: widened with get nodes.storage.k8s.io",
+				},
+			},
+		},
+		{
+			name: "Widened and missing permissions",
+			args: args{
+				rendered: []rbacv1.PolicyRule{
+					{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"*"}},
+					{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"vsphere-cpi-creds"}, Verbs: []string{"get"}},
+				},
+				expectedDiff: []string{
+					"ClusterRole/example: missing get csinodes.storage.k8s.io",
+					"ClusterRole/example: missing get nodes",
+					"ClusterRole/example: missing list nodes",
+					"ClusterRole/example: widened with * nodes",
+					"ClusterRole/example: widened with get secrets/vsphere-cpi-creds",
+				},
+			},
+		},
+		{
+			name: "Role not in the matrix",
+			args: args{
+				rendered:  rules,
+				otherRole: true,
+				expectedDiff: []string{
+					"ClusterRole/example: role is not rendered",
+					"Role/other: role is not in the permission matrix",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			expected := map[string][]rbac.Permission{role: rbac.Flatten(rules)}
+			rendered := map[string][]rbac.Permission{role: rbac.Flatten(tt.args.rendered)}
+			if tt.args.otherRole {
+				rendered = map[string][]rbac.Permission{"Role/other": rbac.Flatten(tt.args.rendered)}
+			}
+
+			// act
+			diff := rbac.Diff(expected, rendered)
+
+			// assert
+			require.Equal(t, tt.args.expectedDiff, diff)
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package unit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/values"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// TestResolveMatchesHelmTemplate checks that the images resolved by pkg/values are the
+// images rendered by helm template, for every Kubernetes minor supported by the charts.
+func TestResolveMatchesHelmTemplate(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		values       map[string]string
+		prime        bool
+		registry     string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{},
+			},
+		},
+		{
+			name: "CPI Prime with registry",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{},
+				prime:        true,
+				registry:     "registry.example.com",
+			},
+		},
+		{
+			name: "CSI",
+			args: args{
+				chartRelPath: csiChart,
+				values:       csiAllImagesValues(),
+			},
+		},
+		{
+			name: "CSI Prime with registry",
+			args: args{
+				chartRelPath: csiChart,
+				values:       csiAllImagesValues(),
+				prime:        true,
+				registry:     "registry.example.com",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		chartPath, err := filepath.Abs(tt.args.chartRelPath)
+		require.NoError(t, err)
+
+		for _, kubeVersion := range supportedMinors(t, chartPath) {
+			t.Run(tt.name+" "+kubeVersion, func(t *testing.T) {
+				// arrange
+				setValues := map[string]string{
+					"global.prime.enabled":                strconv.FormatBool(tt.args.prime),
+					"global.cattle.systemDefaultRegistry": tt.args.registry,
+				}
+				for key, value := range tt.args.values {
+					setValues[key] = value
+				}
+				options := &helm.Options{
+					SetValues:      setValues,
+					KubectlOptions: k8s.NewKubectlOptions("", "", "resolvetest-"+strings.ToLower(random.UniqueId())),
+				}
+
+				// act
+				resolution, err := values.Resolve(values.ResolveOptions{
+					ChartPath:   chartPath,
+					KubeVersion: kubeVersion,
+					Prime:       tt.args.prime,
+					Registry:    tt.args.registry,
+				})
+				require.NoError(t, err)
+				output := helm.RenderTemplate(t, options, chartPath, "resolvetest", nil, "--kube-version", kubeVersion)
+
+				// assert
+				var resolved []string
+				for _, image := range resolution.Images {
+					if !slices.Contains(resolved, image) {
+						resolved = append(resolved, image)
+					}
+				}
+				slices.Sort(resolved)
+				require.Equal(t, resolved, renderedImages(t, output))
+			})
+		}
+	}
+}
+
+// csiAllImagesValues enables every CSI feature that adds a container.
+func csiAllImagesValues() map[string]string {
+	return map[string]string{
+		"vCenter.clusterId":                random.UniqueId(),
+		"csiController.csiResizer.enabled": "true",
+		"blockVolumeSnapshot.enabled":      "true",
+		"csiWindowsSupport.enabled":        "true",
+		"csiMigration.enabled":             "true",
+		"csiController.metricsTLS.enabled": "true",
+	}
+}
+
+// supportedMinors returns the Kubernetes minors matching the catalog.cattle.io/kube-version
+// annotation of the chart at chartPath.
+func supportedMinors(t *testing.T, chartPath string) []string {
+	var chart struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	data, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	require.NoError(t, err)
+	require.NoError(t, yaml.Unmarshal(data, &chart))
+	constraint, err := semver.NewConstraint(chart.Annotations["catalog.cattle.io/kube-version"])
+	require.NoError(t, err)
+
+	var minors []string
+	for minor := 0; minor < 100; minor++ {
+		version := fmt.Sprintf("1.%d", minor)
+		if constraint.Check(semver.MustParse(version)) {
+			minors = append(minors, version)
+		}
+	}
+	require.NotEmpty(t, minors)
+	return minors
+}
+
+// renderedImages returns the sorted, unique images of the workloads and pods in a render.
+func renderedImages(t *testing.T, output string) []string {
+	var images []string
+	for _, manifest := range splitManifests(output) {
+		var object map[string]interface{}
+		helm.UnmarshalK8SYaml(t, manifest, &object)
+
+		var spec v1.PodSpec
+		switch object["kind"] {
+		case "Deployment":
+			var deployment appsv1.Deployment
+			helm.UnmarshalK8SYaml(t, manifest, &deployment)
+			spec = deployment.Spec.Template.Spec
+		case "DaemonSet":
+			var daemonSet appsv1.DaemonSet
+			helm.UnmarshalK8SYaml(t, manifest, &daemonSet)
+			spec = daemonSet.Spec.Template.Spec
+		case "Pod":
+			var pod v1.Pod
+			helm.UnmarshalK8SYaml(t, manifest, &pod)
+			spec = pod.Spec
+		default:
+			continue
+		}
+		for _, container := range append(spec.InitContainers, spec.Containers...) {
+			if !slices.Contains(images, container.Image) {
+				images = append(images, container.Image)
+			}
+		}
+	}
+	slices.Sort(images)
+	return images
+}
+
+// TestVersionOverridesPinnedImages checks that an image repository, tag or Prime tag set in
+// the values is used on every Kubernetes minor supported by the charts, both by helm
+// template and by pkg/values, instead of the one selected by the versionOverrides.
+func TestVersionOverridesPinnedImages(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		cpi          func(*values.CPI)
+		csi          func(*values.CSI)
+		imagePath    string
+		// expectedRepository and expectedTag are not checked when empty
+		expectedRepository string
+		expectedTag        string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI pinned tag",
+			args: args{
+				chartRelPath: cpiChart,
+				cpi:          func(v *values.CPI) { v.CloudControllerManager.Tag = "v1.30.9" },
+				imagePath:    "cloudControllerManager",
+				expectedTag:  "v1.30.9",
+			},
+		},
+		{
+			name: "CPI pinned repository",
+			args: args{
+				chartRelPath:       cpiChart,
+				cpi:                func(v *values.CPI) { v.CloudControllerManager.Repository = "example/cloud-provider-vsphere" },
+				imagePath:          "cloudControllerManager",
+				expectedRepository: "example/cloud-provider-vsphere",
+			},
+		},
+		{
+			name: "CPI pinned Prime tag",
+			args: args{
+				chartRelPath: cpiChart,
+				cpi: func(v *values.CPI) {
+					v.Global.Prime.Enabled = true
+					v.CloudControllerManager.PrimeTag = "v1.33.9-build20261001"
+				},
+				imagePath:          "cloudControllerManager",
+				expectedRepository: "rancher/hardened-cloud-provider-vsphere",
+				expectedTag:        "v1.33.9-build20261001",
+			},
+		},
+		{
+			name: "CSI pinned tag",
+			args: args{
+				chartRelPath: csiChart,
+				csi:          func(v *values.CSI) { v.CSINode.Image.Tag = "v3.3.1" },
+				imagePath:    "csiNode.image",
+				expectedTag:  "v3.3.1",
+			},
+		},
+		{
+			name: "CSI pinned sidecar tag",
+			args: args{
+				chartRelPath: csiChart,
+				csi:          func(v *values.CSI) { v.CSIController.Image.CSIAttacher.Tag = "v4.5.0" },
+				imagePath:    "csiController.image.csiAttacher",
+				expectedTag:  "v4.5.0",
+			},
+		},
+		{
+			name: "CSI pinned repository",
+			args: args{
+				chartRelPath:       csiChart,
+				csi:                func(v *values.CSI) { v.CSIController.Image.Repository = "example/vsphere-csi-driver" },
+				imagePath:          "csiController.image",
+				expectedRepository: "example/vsphere-csi-driver",
+			},
+		},
+		{
+			name: "CSI pinned Prime tag",
+			args: args{
+				chartRelPath: csiChart,
+				csi: func(v *values.CSI) {
+					v.Global.Prime.Enabled = true
+					v.CSIController.Image.PrimeTag = "v3.3.1-build20261001"
+				},
+				imagePath:   "csiController.image",
+				expectedTag: "v3.3.1-build20261001",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		chartPath, err := filepath.Abs(tt.args.chartRelPath)
+		require.NoError(t, err)
+
+		for _, kubeVersion := range supportedMinors(t, chartPath) {
+			t.Run(tt.name+" "+kubeVersion, func(t *testing.T) {
+				// arrange
+				var valuesFile string
+				var references map[string]string
+				if tt.args.cpi != nil {
+					valuesFile = cpiValuesFile(t, chartPath, tt.args.cpi)
+					v, err := values.LoadCPI(valuesFile)
+					require.NoError(t, err)
+					require.NoError(t, v.ApplyVersionOverrides(kubeVersion))
+					references = v.ImageReferences()
+				} else {
+					valuesFile = csiValuesFile(t, chartPath, tt.args.csi)
+					v, err := values.LoadCSI(valuesFile)
+					require.NoError(t, err)
+					require.NoError(t, v.ApplyVersionOverrides(kubeVersion))
+					references = v.ImageReferences()
+				}
+				options := &helm.Options{
+					ValuesFiles:    []string{valuesFile},
+					KubectlOptions: k8s.NewKubectlOptions("", "", "pintest-"+strings.ToLower(random.UniqueId())),
+				}
+
+				// act
+				output := helm.RenderTemplate(t, options, chartPath, "pintest", nil, "--kube-version", kubeVersion)
+
+				// assert
+				image := references[tt.args.imagePath]
+				require.Contains(t, renderedImages(t, output), image)
+				separator := strings.LastIndex(image, ":")
+				if tt.args.expectedRepository != "" {
+					require.Equal(t, tt.args.expectedRepository, image[:separator])
+				}
+				if tt.args.expectedTag != "" {
+					require.Equal(t, tt.args.expectedTag, image[separator+1:])
+				}
+			})
+		}
+	}
+}
+
+// TestKubeVersionGuard checks that helm template and pkg/values fail on a Kubernetes
+// version outside the catalog.cattle.io/kube-version annotation or matched by no
+// versionOverrides entry, unless allowUnsupportedKubeVersion is set.
+func TestKubeVersionGuard(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		kubeVersion  string
+		allow        bool
+		// cpi and csi change the versionOverrides, pkg/values is only checked without them
+		cpi func(*values.CPI)
+		csi func(*values.CSI)
+		// expectedError is part of the error, the render succeeds when empty
+		expectedError string
+		// expectedImage is rendered when the render succeeds
+		expectedImage string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI on Kubernetes 1.26",
+			args: args{
+				chartRelPath:  cpiChart,
+				kubeVersion:   "1.26",
+				expectedError: "is not supported by rancher-vsphere-cpi",
+			},
+		},
+		{
+			name: "CPI on Kubernetes 1.37",
+			args: args{
+				chartRelPath: cpiChart,
+				kubeVersion:  "1.37",
+				// the version skew fallback selects the CPI of Kubernetes 1.36
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+			},
+		},
+		{
+			name: "CPI on Kubernetes 1.38",
+			args: args{
+				chartRelPath:  cpiChart,
+				kubeVersion:   "1.38",
+				expectedError: "is not supported by rancher-vsphere-cpi",
+			},
+		},
+		{
+			name: "CPI on Kubernetes 1.37 allowed",
+			args: args{
+				chartRelPath: cpiChart,
+				kubeVersion:  "1.37",
+				allow:        true,
+				// the version skew fallback selects the CPI of Kubernetes 1.36
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+			},
+		},
+		{
+			name: "CPI on Kubernetes 1.26 allowed",
+			args: args{
+				chartRelPath:  cpiChart,
+				kubeVersion:   "1.26",
+				allow:         true,
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-cpi-release-manager:latest",
+			},
+		},
+		{
+			name: "CPI on Kubernetes 1.36",
+			args: args{
+				chartRelPath:  cpiChart,
+				kubeVersion:   "1.36",
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere:v1.36.0",
+			},
+		},
+		{
+			name: "CPI matched by the catch-all entry only",
+			args: args{
+				chartRelPath:  cpiChart,
+				kubeVersion:   "1.36",
+				cpi:           func(v *values.CPI) { v.VersionOverrides = v.VersionOverrides[:1] },
+				expectedError: "no versionOverrides entry of rancher-vsphere-cpi",
+			},
+		},
+		{
+			name: "CSI on Kubernetes 1.26",
+			args: args{
+				chartRelPath:  csiChart,
+				kubeVersion:   "1.26",
+				expectedError: "is not supported by rancher-vsphere-csi",
+			},
+		},
+		{
+			name: "CSI on Kubernetes 1.37",
+			args: args{
+				chartRelPath:  csiChart,
+				kubeVersion:   "1.37",
+				expectedError: "is not supported by rancher-vsphere-csi",
+			},
+		},
+		{
+			name: "CSI on Kubernetes 1.37 allowed",
+			args: args{
+				chartRelPath:  csiChart,
+				kubeVersion:   "1.37",
+				allow:         true,
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:latest",
+			},
+		},
+		{
+			name: "CSI on Kubernetes 1.36",
+			args: args{
+				chartRelPath:  csiChart,
+				kubeVersion:   "1.36",
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+			},
+		},
+		{
+			name: "CSI matched by no entry",
+			args: args{
+				chartRelPath:  csiChart,
+				kubeVersion:   "1.28",
+				csi:           func(v *values.CSI) { v.VersionOverrides = v.VersionOverrides[:1] },
+				expectedError: "no versionOverrides entry of rancher-vsphere-csi",
+			},
+		},
+		{
+			name: "CSI matched by no entry allowed",
+			args: args{
+				chartRelPath: csiChart,
+				kubeVersion:  "1.28",
+				allow:        true,
+				csi:          func(v *values.CSI) { v.VersionOverrides = v.VersionOverrides[:1] },
+				// the sidecars and the driver are left on latest
+				expectedImage: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:latest",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+			var valuesFile string
+			if tt.args.chartRelPath == cpiChart {
+				valuesFile = cpiValuesFile(t, chartPath, func(v *values.CPI) {
+					v.AllowUnsupportedKubeVersion = tt.args.allow
+					if tt.args.cpi != nil {
+						tt.args.cpi(v)
+					}
+				})
+			} else {
+				valuesFile = csiValuesFile(t, chartPath, func(v *values.CSI) {
+					v.AllowUnsupportedKubeVersion = tt.args.allow
+					if tt.args.csi != nil {
+						tt.args.csi(v)
+					}
+				})
+			}
+			options := &helm.Options{
+				ValuesFiles:    []string{valuesFile},
+				KubectlOptions: k8s.NewKubectlOptions("", "", "guardtest-"+strings.ToLower(random.UniqueId())),
+			}
+
+			// act
+			output, err := helm.RenderTemplateE(t, options, chartPath, "guardtest", nil, "--kube-version", tt.args.kubeVersion)
+
+			// assert
+			if tt.args.expectedError != "" {
+				require.ErrorContains(t, err, tt.args.expectedError)
+			} else {
+				require.NoError(t, err)
+				require.Contains(t, renderedImages(t, output), tt.args.expectedImage)
+			}
+			if tt.args.cpi != nil || tt.args.csi != nil {
+				return
+			}
+			_, err = values.Resolve(values.ResolveOptions{
+				ChartPath:                   chartPath,
+				KubeVersion:                 tt.args.kubeVersion,
+				AllowUnsupportedKubeVersion: tt.args.allow,
+			})
+			if tt.args.expectedError != "" {
+				require.ErrorContains(t, err, tt.args.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
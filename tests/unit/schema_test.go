@@ -0,0 +1,279 @@
+package unit
+
+import (
+	"flag"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/gruntwork-io/terratest/modules/random"
+	"github.com/rancher/vsphere-charts/pkg/schema"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+// TestTemplatesMatchOpenAPISchema renders every template of the charts for every
+// supported Kubernetes minor and validates the objects against the OpenAPI schema of
+// that release, vendored in pkg/schema.
+func TestTemplatesMatchOpenAPISchema(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		values       map[string]string
+		apiVersions  []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{},
+			},
+		},
+		{
+			name: "CPI with nodes and IPv6",
+			args: args{
+				chartRelPath: cpiChart,
+				values: map[string]string{
+					"nodesEnable":                           "true",
+					"vCenter.labels.generate":               "true",
+					"global.ipFamily":                       "ipv6",
+					"cloudControllerManager.nodeSelector.a": "b",
+				},
+			},
+		},
+		{
+			name: "CPI as a Deployment",
+			args: args{
+				chartRelPath: cpiChart,
+				values:       map[string]string{"cloudControllerManager.kind": "Deployment"},
+			},
+		},
+		{
+			name: "CPI with NSX-T load balancer and routes",
+			args: args{
+				chartRelPath: cpiChart,
+				values: withValues(cpiNSXTValues(), map[string]string{
+					"loadBalancer.enabled":          "true",
+					"loadBalancer.tier1GatewayPath": "/infra/tier-1s/t1",
+					"loadBalancer.ipPoolName":       "lb-pool",
+					"route.enabled":                 "true",
+					"route.routerPath":              "/infra/tier-1s/t1",
+					"route.clusterCidr":             "10.42.0.0/16",
+				}),
+			},
+		},
+		{
+			name: "CSI",
+			args: args{
+				chartRelPath: csiChart,
+				values:       map[string]string{"vCenter.clusterId": random.UniqueId()},
+			},
+		},
+		{
+			name: "CSI with all features and self-signed certificates",
+			args: args{
+				chartRelPath: csiChart,
+				values:       csiAllFeaturesValues(),
+			},
+		},
+		{
+			name: "CSI with all features and cert-manager",
+			args: args{
+				chartRelPath: csiChart,
+				values:       csiAllFeaturesValues(),
+				apiVersions:  []string{"cert-manager.io/v1"},
+			},
+		},
+	}
+
+	rendered := map[string]map[string]bool{}
+	for _, tt := range tests {
+		chartPath, err := filepath.Abs(tt.args.chartRelPath)
+		require.NoError(t, err)
+		if rendered[chartPath] == nil {
+			rendered[chartPath] = map[string]bool{}
+		}
+
+		for _, kubeVersion := range supportedMinors(t, chartPath) {
+			t.Run(tt.name+" "+kubeVersion, func(t *testing.T) {
+				// arrange
+				s, err := schema.Load(kubeVersion)
+				require.NoError(t, err)
+				options := &helm.Options{
+					SetValues:      tt.args.values,
+					KubectlOptions: k8s.NewKubectlOptions("", "", "schematest-"+strings.ToLower(random.UniqueId())),
+				}
+				extraArgs := []string{"--kube-version", kubeVersion}
+				for _, apiVersion := range tt.args.apiVersions {
+					extraArgs = append(extraArgs, "--api-versions", apiVersion)
+				}
+
+				// act
+				output := helm.RenderTemplate(t, options, chartPath, "schematest", nil, extraArgs...)
+
+				// assert
+				for _, manifest := range splitManifests(output) {
+					source := manifestSource(manifest)
+					var object map[string]interface{}
+					require.NoError(t, yaml.Unmarshal([]byte(manifest), &object), source)
+					if object == nil {
+						continue
+					}
+					rendered[chartPath][source] = true
+					metadata, _ := object["metadata"].(map[string]interface{})
+					for _, violation := range s.Validate(object) {
+						t.Errorf("%s: %v %v: %s", source, object["kind"], metadata["name"], violation)
+					}
+				}
+			})
+		}
+	}
+
+	if flag.Lookup("test.run").Value.String() != "" {
+		// a -run filter skips cases, so templates may legitimately be left unrendered
+		return
+	}
+	for chartPath, sources := range rendered {
+		templates := chartTemplates(t, chartPath)
+		for _, template := range templates {
+			require.Truef(t, sources[template], "%s is not rendered by any case, add values enabling it", template)
+		}
+	}
+}
+
+// csiAllFeaturesValues enables every optional CSI template.
+func csiAllFeaturesValues() map[string]string {
+	values := csiAllImagesValues()
+	values["csiController.metricsTLS.enabled"] = "true"
+	return values
+}
+
+// cpiNSXTValues are the NSX-T manager and credentials the CPI load balancer requires.
+func cpiNSXTValues() map[string]string {
+	return map[string]string{
+		"nsxt.host":     "nsxt.example.com",
+		"nsxt.username": "admin",
+		"nsxt.password": random.UniqueId(),
+	}
+}
+
+// manifestSource returns the template a manifest of helm template is rendered from,
+// such as rancher-vsphere-csi/templates/csi-driver.yaml.
+func manifestSource(manifest string) string {
+	for _, line := range strings.Split(manifest, "\n") {
+		if source, ok := strings.CutPrefix(line, "# Source: "); ok {
+			return source
+		}
+	}
+	return ""
+}
+
+// chartTemplates returns the templates of a chart that render manifests, named as in
+// the # Source comments of helm template.
+func chartTemplates(t *testing.T, chartPath string) []string {
+	var templates []string
+	err := filepath.WalkDir(filepath.Join(chartPath, "templates"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".yaml" {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		templates = append(templates, filepath.Base(chartPath)+"/"+filepath.ToSlash(rel))
+		return nil
+	})
+	require.NoError(t, err)
+	return templates
+}
+
+func TestSchemaValidate(t *testing.T) {
+	type args struct {
+		kubeVersion        string
+		manifest           string
+		expectedViolations []string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Valid manifest",
+			args: args{
+				kubeVersion:        "1.36",
+				manifest:           "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  labels:\n    app.kubernetes.io/name: a\ndata:\n  key: value\n",
+				expectedViolations: nil,
+			},
+		},
+		{
+			name: "Unknown field",
+			args: args{
+				kubeVersion:        "1.36",
+				manifest:           "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: a\nspec:\n  selector: {}\n  template:\n    spec:\n      containers:\n      - name: a\n        imagePullPolicies: Always\n",
+				expectedViolations: []string{"spec.template.spec.containers[0].imagePullPolicies: unknown field"},
+			},
+		},
+		{
+			name: "Wrong type and missing required field",
+			args: args{
+				kubeVersion: "1.30",
+				manifest:    "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: a\nspec:\n  replicas: two\n",
+				expectedViolations: []string{
+					"spec.replicas: expected integer, got string",
+					"spec.selector: required field is missing",
+					"spec.template: required field is missing",
+				},
+			},
+		},
+		{
+			name: "Deprecated field",
+			args: args{
+				kubeVersion:        "1.27",
+				manifest:           "apiVersion: v1\nkind: Pod\nmetadata:\n  name: a\nspec:\n  serviceAccount: a\n  containers: []\n",
+				expectedViolations: []string{"spec.serviceAccount: field is deprecated"},
+			},
+		},
+		{
+			name: "Removed API version",
+			args: args{
+				kubeVersion:        "1.27",
+				manifest:           "apiVersion: policy/v1beta1\nkind: PodDisruptionBudget\nmetadata:\n  name: a\n",
+				expectedViolations: []string{"apiVersion: policy/v1beta1 PodDisruptionBudget is not served by Kubernetes 1.27"},
+			},
+		},
+		{
+			name: "Custom resource",
+			args: args{
+				kubeVersion:        "1.36",
+				manifest:           "apiVersion: cert-manager.io/v1\nkind: Issuer\nmetadata:\n  name: a\nspec:\n  selfSigned: {}\n",
+				expectedViolations: nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			s, err := schema.Load(tt.args.kubeVersion)
+			require.NoError(t, err)
+			var object map[string]interface{}
+			require.NoError(t, yaml.Unmarshal([]byte(tt.args.manifest), &object))
+
+			// act
+			violations := s.Validate(object)
+
+			// assert
+			var actual []string
+			for _, violation := range violations {
+				actual = append(actual, violation.String())
+			}
+			require.Equal(t, tt.args.expectedViolations, actual)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package unit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rancher/vsphere-charts/pkg/values"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+const updatecliDir = "../../updatecli/updatecli.d"
+
+// updatecliTarget is the part of an updatecli target the tests check.
+type updatecliTarget struct {
+	Kind     string `json:"kind"`
+	SourceID string `json:"sourceid"`
+	Spec     struct {
+		File string   `json:"file"`
+		Key  string   `json:"key"`
+		Keys []string `json:"keys"`
+	} `json:"spec"`
+}
+
+// updatecliSource is the part of an updatecli source the tests check.
+type updatecliSource struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		VersionFilter struct {
+			Pattern string `json:"pattern"`
+		} `json:"versionfilter"`
+	} `json:"spec"`
+}
+
+// updatecliYAMLKeys returns the values.yaml keys written by the yaml targets of an
+// updatecli manifest, by file.
+func updatecliYAMLKeys(t *testing.T, manifest string) map[string][]string {
+	data, err := os.ReadFile(filepath.Join(updatecliDir, manifest))
+	require.NoError(t, err)
+
+	var config struct {
+		Targets map[string]updatecliTarget `json:"targets"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &config))
+
+	keys := map[string][]string{}
+	for _, target := range config.Targets {
+		if target.Kind != "yaml" {
+			continue
+		}
+		if target.Spec.Key != "" {
+			keys[target.Spec.File] = append(keys[target.Spec.File], target.Spec.Key)
+		}
+		keys[target.Spec.File] = append(keys[target.Spec.File], target.Spec.Keys...)
+	}
+	return keys
+}
+
+// pinnedPrimeTags returns the paths of the primeTag values set in a values tree.
+func pinnedPrimeTags(path string, node any) []string {
+	var paths []string
+	switch node := node.(type) {
+	case map[string]any:
+		for key, value := range node {
+			child := strings.TrimPrefix(path+"."+key, ".")
+			if tag, ok := value.(string); ok && key == "primeTag" && tag != "" {
+				paths = append(paths, child)
+				continue
+			}
+			paths = append(paths, pinnedPrimeTags(child, value)...)
+		}
+	case []any:
+		for i, value := range node {
+			paths = append(paths, pinnedPrimeTags(fmt.Sprintf("%s[%d]", path, i), value)...)
+		}
+	}
+	return paths
+}
+
+// TestUpdatecliCSIPrimeTags checks that updatecli bumps every primeTag pinned in the
+// CSI values, so no Prime image is left behind on a release.
+func TestUpdatecliCSIPrimeTags(t *testing.T) {
+	// arrange
+	data, err := os.ReadFile(filepath.Join(csiChart, "values.yaml"))
+	require.NoError(t, err)
+	var chartValues map[string]any
+	require.NoError(t, yaml.Unmarshal(data, &chartValues))
+
+	// act
+	keys := updatecliYAMLKeys(t, "update-csi-images.yaml")["charts/rancher-vsphere-csi/values.yaml"]
+	pinned := pinnedPrimeTags("", chartValues)
+
+	// assert
+	sort.Strings(keys)
+	sort.Strings(pinned)
+	require.NotEmpty(t, pinned)
+	require.Equal(t, pinned, keys)
+}
+
+// TestUpdatecliCPIPrimeTags checks that every CPI primeTag target of updatecli writes the
+// versionOverrides entry whose constraint matches the Kubernetes minor of its source, so
+// that shifting the entries does not bump the tags of another minor.
+func TestUpdatecliCPIPrimeTags(t *testing.T) {
+	// arrange
+	data, err := os.ReadFile(filepath.Join(updatecliDir, "update-cpi-images.yaml"))
+	require.NoError(t, err)
+	var config struct {
+		Sources map[string]updatecliSource `json:"sources"`
+		Targets map[string]updatecliTarget `json:"targets"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &config))
+
+	chartValues, err := values.LoadCPIChart(cpiChart)
+	require.NoError(t, err)
+
+	keyPattern := regexp.MustCompile(`^versionOverrides\[(\d+)\]\.values\.cloudControllerManager\.primeTag$`)
+	minorPattern := regexp.MustCompile(`^\^v1\\\.(\d+)\\\.`)
+
+	// act
+	expected := map[string]string{}
+	actual := map[string]string{}
+	for name, target := range config.Targets {
+		if target.Kind != "yaml" || target.Spec.File != "charts/rancher-vsphere-cpi/values.yaml" {
+			continue
+		}
+		source, ok := config.Sources[target.SourceID]
+		require.True(t, ok, "%s: unknown source %q", name, target.SourceID)
+		minor := minorPattern.FindStringSubmatch(source.Spec.VersionFilter.Pattern)
+		require.NotNil(t, minor, "%s: unexpected version filter %q", name, source.Spec.VersionFilter.Pattern)
+		expected[name] = "~ 1." + minor[1]
+
+		match := keyPattern.FindStringSubmatch(target.Spec.Key)
+		require.NotNil(t, match, "%s: unexpected key %q", name, target.Spec.Key)
+		index, err := strconv.Atoi(match[1])
+		require.NoError(t, err)
+		require.Less(t, index, len(chartValues.VersionOverrides), "%s: %s", name, target.Spec.Key)
+		override := chartValues.VersionOverrides[index]
+		require.NotNil(t, override.Values.CloudControllerManager, "%s: %s", name, target.Spec.Key)
+		require.NotEmpty(t, override.Values.CloudControllerManager.PrimeTag, "%s: %s", name, target.Spec.Key)
+		actual[name] = override.Constraint
+	}
+
+	// assert
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, actual)
+}
@@ -0,0 +1,462 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/vsphere-charts/pkg/values"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestValuesRoundTrip(t *testing.T) {
+	type args struct {
+		chartRelPath string
+		load         func(chartPath string) (interface{ YAML() ([]byte, error) }, error)
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "CPI values",
+			args: args{
+				chartRelPath: cpiChart,
+				load: func(chartPath string) (interface{ YAML() ([]byte, error) }, error) {
+					return values.LoadCPIChart(chartPath)
+				},
+			},
+		},
+		{
+			name: "CSI values",
+			args: args{
+				chartRelPath: csiChart,
+				load: func(chartPath string) (interface{ YAML() ([]byte, error) }, error) {
+					return values.LoadCSIChart(chartPath)
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(tt.args.chartRelPath)
+			require.NoError(t, err)
+			original, err := os.ReadFile(filepath.Join(chartPath, values.ValuesFile))
+			require.NoError(t, err)
+
+			// act
+			v, err := tt.args.load(chartPath)
+			require.NoError(t, err)
+			encoded, err := v.YAML()
+			require.NoError(t, err)
+
+			// assert
+			var expected, actual interface{}
+			require.NoError(t, yaml.Unmarshal(original, &expected))
+			require.NoError(t, yaml.Unmarshal(encoded, &actual))
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestValuesValidate(t *testing.T) {
+	type args struct {
+		cpi           func(*values.CPI)
+		csi           func(*values.CSI)
+		expectedError string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Chart defaults",
+			args: args{
+				cpi:           func(*values.CPI) {},
+				csi:           func(*values.CSI) {},
+				expectedError: "",
+			},
+		},
+		{
+			name: "Invalid distribution",
+			args: args{
+				cpi:           func(v *values.CPI) { v.Global.Distribution = "rke3" },
+				csi:           func(v *values.CSI) { v.Global.Distribution = "rke3" },
+				expectedError: `global.distribution: must be one of , rke1, rke2, k3s, generic, got "rke3"`,
+			},
+		},
+		{
+			name: "Invalid versionOverrides constraint",
+			args: args{
+				cpi:           func(v *values.CPI) { v.VersionOverrides[0].Constraint = "~ one" },
+				csi:           func(v *values.CSI) { v.VersionOverrides[0].Constraint = "~ one" },
+				expectedError: "versionOverrides[0].constraint:",
+			},
+		},
+		{
+			name: "Invalid port",
+			args: args{
+				cpi:           func(v *values.CPI) { v.VCenter.Port = 0 },
+				csi:           func(v *values.CSI) { v.VCenter.Port = 0 },
+				expectedError: "vCenter.port: must be between 1 and 65535, got 0",
+			},
+		},
+		{
+			name: "Invalid proxy",
+			args: args{
+				cpi:           func(v *values.CPI) { v.Global.Proxy.HTTPSProxy = "proxy.example.com:3128" },
+				csi:           func(v *values.CSI) { v.Global.Proxy.HTTPSProxy = "proxy.example.com:3128" },
+				expectedError: `global.proxy.httpsProxy: must be a URL such as http://proxy.example.com:3128, got "proxy.example.com:3128"`,
+			},
+		},
+		{
+			name: "Invalid proxy service CIDR",
+			args: args{
+				cpi:           func(v *values.CPI) { v.Global.Proxy.ServiceCidr = "10.43.0.0" },
+				csi:           func(v *values.CSI) { v.Global.Proxy.ServiceCidr = "10.43.0.0" },
+				expectedError: "global.proxy.serviceCidr: invalid CIDR address: 10.43.0.0",
+			},
+		},
+		{
+			name: "Missing Prime image repository",
+			args: args{
+				cpi:           func(v *values.CPI) { v.CloudControllerManager.PrimeRepository = "" },
+				csi:           func(v *values.CSI) { v.CSIController.Image.CSIAttacher.PrimeRepository = "" },
+				expectedError: ".primeRepository: must be set",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			cpiChartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+			csiChartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+			cpi, err := values.LoadCPIChart(cpiChartPath)
+			require.NoError(t, err)
+			csi, err := values.LoadCSIChart(csiChartPath)
+			require.NoError(t, err)
+			tt.args.cpi(cpi)
+			tt.args.csi(csi)
+
+			// act
+			cpiErr := cpi.Validate()
+			csiErr := csi.Validate()
+
+			// assert
+			if tt.args.expectedError == "" {
+				require.NoError(t, cpiErr)
+				require.NoError(t, csiErr)
+			} else {
+				require.ErrorContains(t, cpiErr, tt.args.expectedError)
+				require.ErrorContains(t, csiErr, tt.args.expectedError)
+			}
+		})
+	}
+}
+
+func TestValuesLoadStrict(t *testing.T) {
+	type args struct {
+		content       string
+		expectedError string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Known keys",
+			args: args{
+				content:       "csiController:\n  priorityClassName: infra-critical\n",
+				expectedError: "",
+			},
+		},
+		{
+			name: "Misspelled key",
+			args: args{
+				content:       "csiController:\n  priorityClass: infra-critical\n",
+				expectedError: `unknown field "priorityClass"`,
+			},
+		},
+		{
+			name: "Wrong type",
+			args: args{
+				content:       "vCenter:\n  port: https\n",
+				expectedError: "vCenter.port",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			path := filepath.Join(t.TempDir(), "values.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.args.content), 0o644))
+
+			// act
+			_, err := values.LoadCSI(path)
+
+			// assert
+			if tt.args.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.args.expectedError)
+			}
+		})
+	}
+}
+
+func TestValuesImageReference(t *testing.T) {
+	image := values.ImageRef{
+		Repository:      "rancher/mirrored-cloud-provider-vsphere-csi-release-driver",
+		PrimeRepository: "rancher/hardened-vsphere-csi-driver",
+		Tag:             "v3.7.2",
+		PrimeTag:        "v3.7.2-build20260722",
+	}
+	type args struct {
+		image             values.ImageRef
+		prime             bool
+		registry          string
+		expectedReference string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Community",
+			args: args{
+				image:             image,
+				expectedReference: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:v3.7.2",
+			},
+		},
+		{
+			name: "Prime with registry",
+			args: args{
+				image:             image,
+				prime:             true,
+				registry:          "registry.rancher.com",
+				expectedReference: "registry.rancher.com/rancher/hardened-vsphere-csi-driver:v3.7.2-build20260722",
+			},
+		},
+		{
+			name: "Unpinned",
+			args: args{
+				image:             values.ImageRef{Repository: image.Repository, PrimeRepository: image.PrimeRepository},
+				expectedReference: "rancher/mirrored-cloud-provider-vsphere-csi-release-driver:latest",
+			},
+		},
+		{
+			name: "Unpinned Prime",
+			args: args{
+				image:             values.ImageRef{Repository: image.Repository, PrimeRepository: image.PrimeRepository},
+				prime:             true,
+				registry:          "registry.rancher.com",
+				expectedReference: "registry.rancher.com/rancher/hardened-vsphere-csi-driver:latest",
+			},
+		},
+		{
+			name: "Prime without primeTag",
+			args: args{
+				image:             values.ImageRef{Repository: image.Repository, PrimeRepository: image.PrimeRepository, Tag: image.Tag},
+				prime:             true,
+				expectedReference: "rancher/hardened-vsphere-csi-driver:v3.7.2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// act
+			reference := tt.args.image.Reference(tt.args.prime, tt.args.registry)
+
+			// assert
+			require.Equal(t, tt.args.expectedReference, reference)
+		})
+	}
+}
+
+func TestValuesApplyVersionOverrides(t *testing.T) {
+	type args struct {
+		kubeVersion         string
+		expectedCPITag      string
+		expectedCPIPrimeTag string
+		// expectedCSITag is empty when no override matches, the images then render as latest
+		expectedCSITag       string
+		expectedAttacherTag  string
+		expectedRegistrarTag string
+		expectedCSIPrimeTag  string
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Kubernetes 1.36",
+			args: args{
+				kubeVersion:          "1.36.2",
+				expectedCPITag:       "v1.36.0",
+				expectedCPIPrimeTag:  "v1.36.0-build20260722",
+				expectedCSITag:       "v3.7.2",
+				expectedAttacherTag:  "v4.9.0",
+				expectedRegistrarTag: "v2.13.0",
+				expectedCSIPrimeTag:  "v3.7.2-build20260722",
+			},
+		},
+		{
+			name: "Kubernetes 1.30",
+			args: args{
+				kubeVersion:          "v1.30.4+rke2r1",
+				expectedCPITag:       "v1.30.1",
+				expectedCPIPrimeTag:  "latest",
+				expectedCSITag:       "v3.3.1",
+				expectedAttacherTag:  "v4.7.0",
+				expectedRegistrarTag: "v2.12.0",
+				expectedCSIPrimeTag:  "v3.7.2-build20260722",
+			},
+		},
+		{
+			name: "Kubernetes 1.37 without a CPI release",
+			args: args{
+				kubeVersion:          "1.37.0",
+				expectedCPITag:       "v1.36.0",
+				expectedCPIPrimeTag:  "v1.36.0-build20260722",
+				expectedCSITag:       "",
+				expectedAttacherTag:  "",
+				expectedRegistrarTag: "",
+				expectedCSIPrimeTag:  "v3.7.2-build20260722",
+			},
+		},
+		{
+			name: "Unsupported Kubernetes version",
+			args: args{
+				kubeVersion:          "1.20.0",
+				expectedCPITag:       "latest",
+				expectedCPIPrimeTag:  "latest",
+				expectedCSITag:       "",
+				expectedAttacherTag:  "",
+				expectedRegistrarTag: "",
+				expectedCSIPrimeTag:  "v3.7.2-build20260722",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			cpiChartPath, err := filepath.Abs(cpiChart)
+			require.NoError(t, err)
+			csiChartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+			cpi, err := values.LoadCPIChart(cpiChartPath)
+			require.NoError(t, err)
+			csi, err := values.LoadCSIChart(csiChartPath)
+			require.NoError(t, err)
+			defaults, err := csi.DeepCopy()
+			require.NoError(t, err)
+
+			// act
+			require.NoError(t, cpi.ApplyVersionOverrides(tt.args.kubeVersion))
+			require.NoError(t, csi.ApplyVersionOverrides(tt.args.kubeVersion))
+
+			// assert
+			require.Equal(t, tt.args.expectedCPITag, cpi.CloudControllerManager.Tag)
+			require.Equal(t, tt.args.expectedCPIPrimeTag, cpi.CloudControllerManager.PrimeTag)
+			require.Equal(t, tt.args.expectedCSITag, csi.CSIController.Image.Tag)
+			require.Equal(t, tt.args.expectedCSITag, csi.CSINode.Image.Tag)
+			require.Equal(t, tt.args.expectedAttacherTag, csi.CSIController.Image.CSIAttacher.Tag)
+			require.Equal(t, tt.args.expectedRegistrarTag, csi.CSINode.Image.NodeDriverRegistrar.Tag)
+			require.Equal(t, tt.args.expectedCSIPrimeTag, csi.CSIController.Image.PrimeTag)
+			require.Equal(t, defaults.CSIController.Image.PrimeRepository, csi.CSIController.Image.PrimeRepository)
+			require.Equal(t, defaults.CSIController.PriorityClassName, csi.CSIController.PriorityClassName)
+		})
+	}
+}
+
+func TestValuesApplyVersionOverridesPrecedence(t *testing.T) {
+	enabled, disabled := true, false
+	type args struct {
+		values                func(*values.CSI)
+		expectedTag           string
+		expectedAttacherTag   string
+		expectedResizer       bool
+		expectedListVolumes   bool
+		expectedFeatureStates map[string]bool
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{
+			name: "Version defaults fill the unset values",
+			args: args{
+				values:                func(*values.CSI) {},
+				expectedTag:           "v3.7.2",
+				expectedAttacherTag:   "v4.9.0",
+				expectedResizer:       true,
+				expectedListVolumes:   true,
+				expectedFeatureStates: map[string]bool{"list-volumes": true, "fss-new-feature": false},
+			},
+		},
+		{
+			name: "User values win over version defaults",
+			args: args{
+				values: func(v *values.CSI) {
+					v.CSIController.Image.Tag = "v3.7.2-hotfix"
+					v.CSIController.CSIResizer.Enabled = &disabled
+					v.ListVolumes.Enabled = &disabled
+					v.FeatureStates = map[string]bool{"list-volumes": false}
+				},
+				expectedTag:           "v3.7.2-hotfix",
+				expectedAttacherTag:   "v4.9.0",
+				expectedResizer:       false,
+				expectedListVolumes:   false,
+				expectedFeatureStates: map[string]bool{"list-volumes": false, "fss-new-feature": false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			chartPath, err := filepath.Abs(csiChart)
+			require.NoError(t, err)
+			csi, err := values.LoadCSIChart(chartPath)
+			require.NoError(t, err)
+			csi.VersionOverrides = append(csi.VersionOverrides,
+				values.VersionOverride[values.CSIOverrides]{
+					Constraint: ">= 1.31",
+					Values: values.CSIOverrides{
+						CSIController: &values.CSIControllerOverrides{
+							CSIResizer: &values.FeatureOverride{Enabled: &enabled},
+						},
+						ListVolumes:   &values.FeatureOverride{Enabled: &enabled},
+						FeatureStates: map[string]bool{"list-volumes": true, "fss-new-feature": true},
+					},
+				},
+				values.VersionOverride[values.CSIOverrides]{
+					Constraint: ">= 1.36",
+					Values:     values.CSIOverrides{FeatureStates: map[string]bool{"fss-new-feature": false}},
+				},
+			)
+			tt.args.values(csi)
+
+			// act
+			require.NoError(t, csi.ApplyVersionOverrides("1.36.2"))
+
+			// assert
+			require.Equal(t, tt.args.expectedTag, csi.CSIController.Image.Tag)
+			require.Equal(t, tt.args.expectedAttacherTag, csi.CSIController.Image.CSIAttacher.Tag)
+			require.NotNil(t, csi.CSIController.CSIResizer.Enabled)
+			require.Equal(t, tt.args.expectedResizer, *csi.CSIController.CSIResizer.Enabled)
+			require.NotNil(t, csi.ListVolumes.Enabled)
+			require.Equal(t, tt.args.expectedListVolumes, *csi.ListVolumes.Enabled)
+			require.Equal(t, tt.args.expectedFeatureStates, csi.FeatureStates)
+		})
+	}
+}
@@ -0,0 +1,296 @@
+// Package vcsim renders the vCenter configuration of the charts against govmomi's
+// in-process vCenter simulator and loads it with the upstream CPI and CSI config loaders,
+// so that a typo in a config template fails the tests instead of a real install. The
+// check of the helm test pods is run against the simulator as well.
+package vcsim
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gruntwork-io/terratest/modules/helm"
+	"github.com/gruntwork-io/terratest/modules/k8s"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	v1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	cpiconfig "k8s.io/cloud-provider-vsphere/pkg/common/config"
+	"k8s.io/cloud-provider-vsphere/pkg/common/credentialmanager"
+	"k8s.io/cloud-provider-vsphere/pkg/common/vclib"
+	"sigs.k8s.io/vsphere-csi-driver/v3/pkg/common/cns-lib/vsphere"
+	csiconfig "sigs.k8s.io/vsphere-csi-driver/v3/pkg/common/config"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	cpiChart = "../../charts/rancher-vsphere-cpi"
+	csiChart = "../../charts/rancher-vsphere-csi"
+
+	// The CSI driver requires the username to contain the domain.
+	username = "administrator@vsphere.local"
+	password = "vcsim-password"
+	// namespace is the release namespace, the CPI reads its credentials from a Secret in it.
+	namespace = "kube-system"
+)
+
+// vcenter is a running simulator, with the datacenters DC0 and DC1.
+type vcenter struct {
+	host string
+	port string
+}
+
+// startVCenter starts a simulator accepting only username and the given password, over
+// TLS with a certificate no system CA trusts.
+func startVCenter(t *testing.T, password string) vcenter {
+	model := simulator.VPX()
+	model.Datacenter = 2
+	require.NoError(t, model.Create())
+	t.Cleanup(model.Remove)
+
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword(username, password)}
+	server := model.Service.NewServer()
+	t.Cleanup(server.Close)
+	return vcenter{host: server.URL.Hostname(), port: server.URL.Port()}
+}
+
+// renderSecret renders a Secret template of a chart and decodes it.
+func renderSecret(t *testing.T, chartRelPath, template string, values map[string]string) *v1.Secret {
+	secret := &v1.Secret{}
+	require.NoError(t, yaml.Unmarshal([]byte(render(t, chartRelPath, template, values)), secret))
+	require.Equal(t, "Secret", secret.Kind)
+	return secret
+}
+
+func render(t *testing.T, chartRelPath, template string, values map[string]string) string {
+	chartPath, err := filepath.Abs(chartRelPath)
+	require.NoError(t, err)
+	options := &helm.Options{
+		SetValues:      values,
+		KubectlOptions: k8s.NewKubectlOptions("", "", namespace),
+	}
+	// the charts refuse the default Kubernetes version of helm template
+	return helm.RenderTemplate(t, options, chartPath, "vcsimtest", []string{template}, "--kube-version", "1.36")
+}
+
+type args struct {
+	// values are set on top of the simulator host, port and credentials
+	values map[string]string
+	// insecure is the insecureFlag value
+	insecure    bool
+	datacenters string
+	// expectedError is part of the connection error, empty when the login and the
+	// lookup of every datacenter succeed
+	expectedError string
+}
+
+var tests = []struct {
+	name string
+	args args
+}{
+	{
+		name: "Single datacenter",
+		args: args{insecure: true, datacenters: "DC0"},
+	},
+	{
+		name: "Several datacenters",
+		args: args{insecure: true, datacenters: "DC0,DC1"},
+	},
+	{
+		name: "Wrong password",
+		args: args{
+			values:        map[string]string{"vCenter.password": "wrong"},
+			insecure:      true,
+			datacenters:   "DC0",
+			expectedError: "Login failure",
+		},
+	},
+	{
+		name: "Untrusted certificate without insecureFlag",
+		args: args{insecure: false, datacenters: "DC0", expectedError: "x509"},
+	},
+	{
+		name: "Missing datacenter",
+		args: args{insecure: true, datacenters: "DC0,DC9", expectedError: "DC9"},
+	},
+}
+
+// TestCPIConfig loads the rendered vsphere.yaml and credentials Secret the way the CPI
+// does, then logs in and looks up the configured datacenters.
+func TestCPIConfig(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			ctx := context.Background()
+			vc := startVCenter(t, password)
+			values := map[string]string{
+				"vCenter.host":         vc.host,
+				"vCenter.port":         vc.port,
+				"vCenter.username":     username,
+				"vCenter.password":     password,
+				"vCenter.insecureFlag": boolValue(tt.args.insecure),
+				"vCenter.datacenters":  strings.ReplaceAll(tt.args.datacenters, ",", `\,`),
+			}
+			values = withValues(values, tt.args.values)
+			configMap := &v1.ConfigMap{}
+			require.NoError(t, yaml.Unmarshal([]byte(render(t, cpiChart, "templates/configmap.yaml", values)), configMap))
+			secret := renderSecret(t, cpiChart, "templates/secret.yaml", values)
+
+			// act
+			cfg, err := cpiconfig.ReadConfig([]byte(configMap.Data["vsphere.yaml"]))
+			require.NoError(t, err)
+			require.Len(t, cfg.VirtualCenter, 1)
+			err = connectCPI(ctx, cfg, secret)
+
+			// assert
+			if tt.args.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.args.expectedError)
+			}
+		})
+	}
+}
+
+// connectCPI logs in to every vCenter of cfg with the credentials found by the CPI
+// credential manager and looks up their datacenters.
+func connectCPI(ctx context.Context, cfg *cpiconfig.Config, secret *v1.Secret) error {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(secret); err != nil {
+		return err
+	}
+	for _, vcConfig := range cfg.VirtualCenter {
+		secretName, secretNamespace := vcConfig.SecretName, vcConfig.SecretNamespace
+		if vcConfig.SecretRef == cpiconfig.DefaultCredentialManager {
+			secretName, secretNamespace = cfg.Global.SecretName, cfg.Global.SecretNamespace
+		}
+		credentials, err := credentialmanager.NewCredentialManager(secretName, secretNamespace, "", corelisters.NewSecretLister(indexer)).
+			GetCredential(vcConfig.VCenterIP)
+		if err != nil {
+			return err
+		}
+		connection := &vclib.VSphereConnection{
+			Username:          credentials.User,
+			Password:          credentials.Password,
+			Hostname:          vcConfig.VCenterIP,
+			Port:              vcConfig.VCenterPort,
+			Insecure:          vcConfig.InsecureFlag,
+			RoundTripperCount: vcConfig.RoundTripperCount,
+			CACert:            vcConfig.CAFile,
+			Thumbprint:        vcConfig.Thumbprint,
+		}
+		if err := connection.Connect(ctx); err != nil {
+			return err
+		}
+		defer connection.Logout(ctx)
+		for _, datacenter := range strings.Split(vcConfig.Datacenters, ",") {
+			if _, err := vclib.GetDatacenter(ctx, connection, strings.TrimSpace(datacenter)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TestCSIConfig loads the rendered csi-vsphere.conf the way the CSI driver does, then
+// logs in and looks up the configured datacenters.
+func TestCSIConfig(t *testing.T) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			ctx := context.Background()
+			vc := startVCenter(t, password)
+			insecureFlag := "0"
+			if tt.args.insecure {
+				insecureFlag = "1"
+			}
+			values := map[string]string{
+				"vCenter.clusterId":    "vcsim",
+				"vCenter.host":         vc.host,
+				"vCenter.port":         vc.port,
+				"vCenter.username":     username,
+				"vCenter.password":     password,
+				"vCenter.insecureFlag": insecureFlag,
+				"vCenter.datacenters":  strings.ReplaceAll(tt.args.datacenters, ",", `\,`),
+			}
+			values = withValues(values, tt.args.values)
+			secret := renderSecret(t, csiChart, "templates/secret.yaml", values)
+
+			// the driver reads the file mounted from the Secret, again when it logs in
+			configPath := filepath.Join(t.TempDir(), "csi-vsphere.conf")
+			require.NoError(t, os.WriteFile(configPath, secret.Data["csi-vsphere.conf"], 0o600))
+			t.Setenv(csiconfig.EnvVSphereCSIConfig, configPath)
+
+			// act
+			cfg, err := csiconfig.GetCnsconfig(ctx, configPath)
+			require.NoError(t, err)
+			err = connectCSI(ctx, cfg, strings.Split(tt.args.datacenters, ","))
+
+			// assert
+			if tt.args.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.args.expectedError)
+			}
+		})
+	}
+}
+
+// connectCSI logs in to the vCenter of cfg like the CSI controller and checks every
+// expected datacenter is found.
+func connectCSI(ctx context.Context, cfg *csiconfig.Config, expected []string) error {
+	vcConfig, err := vsphere.GetVirtualCenterConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	vc := &vsphere.VirtualCenter{Config: vcConfig, ClientMutex: &sync.Mutex{}}
+	datacenters, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return err
+	}
+	defer vc.Disconnect(ctx)
+	var found []string
+	for _, datacenter := range datacenters {
+		found = append(found, datacenter.Name())
+	}
+	for _, name := range expected {
+		if !slices.Contains(found, name) {
+			return &missingDatacenterError{name: name, found: found}
+		}
+	}
+	return nil
+}
+
+// missingDatacenterError is returned when the CSI driver skips a datacenter it could not
+// find, which it only logs.
+type missingDatacenterError struct {
+	name  string
+	found []string
+}
+
+func (e *missingDatacenterError) Error() string {
+	return "datacenter " + e.name + " not found, found " + strings.Join(e.found, ",")
+}
+
+func boolValue(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// withValues returns values with the entries of extra added.
+func withValues(values, extra map[string]string) map[string]string {
+	for key, value := range extra {
+		values[key] = value
+	}
+	return values
+}
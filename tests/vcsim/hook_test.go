@@ -0,0 +1,211 @@
+package vcsim
+
+import (
+	"cmp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+type hookArgs struct {
+	// values are set on top of the simulator host, port and credentials
+	values      map[string]string
+	insecure    bool
+	datacenters string
+	// password is that of the simulator, the password constant when empty
+	password string
+	// cpiOnly runs the test for the CPI only, the values not being those of the CSI
+	cpiOnly bool
+	// expectedOutput is part of the output of the check
+	expectedOutput string
+}
+
+var hookTests = []struct {
+	name string
+	args hookArgs
+}{
+	{
+		name: "Single datacenter",
+		args: hookArgs{insecure: true, datacenters: "DC0", expectedOutput: "OK: logged in to 127.0.0.1 as administrator@vsphere.local and found the datacenters DC0\n"},
+	},
+	{
+		name: "Several datacenters",
+		args: hookArgs{insecure: true, datacenters: "DC0,DC1", expectedOutput: "OK: logged in to 127.0.0.1 as administrator@vsphere.local and found the datacenters DC0 DC1\n"},
+	},
+	{
+		name: "Wrong password",
+		args: hookArgs{
+			values:         map[string]string{"vCenter.password": "wrong"},
+			insecure:       true,
+			datacenters:    "DC0",
+			expectedOutput: "FAILED (AUTH)",
+		},
+	},
+	{
+		name: "Password with escaped characters",
+		args: hookArgs{
+			password:       "vcsim\tpass\nword & \"quoted\" <'xml'>",
+			insecure:       true,
+			datacenters:    "DC0",
+			expectedOutput: "OK: logged in to 127.0.0.1",
+		},
+	},
+	{
+		name: "Credentials in secretsDirectory",
+		args: hookArgs{
+			values:         map[string]string{"vCenter.secretsDirectory": "/etc/vsphere-secrets"},
+			insecure:       true,
+			datacenters:    "DC0",
+			cpiOnly:        true,
+			expectedOutput: "OK: reached 127.0.0.1, the login and the datacenters are not checked as the credentials are in the secretsDirectory /etc/vsphere-secrets of the cloud controller manager\n",
+		},
+	},
+	{
+		name: "Untrusted certificate without insecureFlag",
+		args: hookArgs{insecure: false, datacenters: "DC0", expectedOutput: "FAILED (TLS)"},
+	},
+	{
+		name: "Missing datacenter",
+		args: hookArgs{insecure: true, datacenters: "DC0,DC9", expectedOutput: "FAILED (DATACENTER): datacenter DC9 is not found"},
+	},
+	{
+		name: "Unresolvable host",
+		args: hookArgs{
+			values:         map[string]string{"vCenter.host": "vcenter.invalid"},
+			insecure:       true,
+			datacenters:    "DC0",
+			expectedOutput: "FAILED (DNS)",
+		},
+	},
+	{
+		name: "Closed port",
+		args: hookArgs{
+			values:         map[string]string{"vCenter.port": "1"},
+			insecure:       true,
+			datacenters:    "DC0",
+			expectedOutput: "FAILED (CONNECTION)",
+		},
+	},
+}
+
+// runHook runs the check of the rendered test pod against the simulator, with the
+// mounted files of the pod written to dir, and returns its combined output.
+func runHook(t *testing.T, pod *v1.Pod, dir string) (string, error) {
+	for _, tool := range []string{"bash", "curl", "getent"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required to run the test pod check: %v", tool, err)
+		}
+	}
+	require.Len(t, pod.Spec.Containers, 1)
+	container := pod.Spec.Containers[0]
+
+	cmd := exec.Command(container.Command[0], container.Command[1:]...)
+	// no proxy of the environment applies to the simulator
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH")}
+	for _, env := range container.Env {
+		value := env.Value
+		if strings.HasPrefix(value, "/etc/") {
+			value = filepath.Join(dir, value)
+		}
+		cmd.Env = append(cmd.Env, env.Name+"="+value)
+	}
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// renderPod renders the test pod of a chart and decodes it.
+func renderPod(t *testing.T, chartRelPath string, values map[string]string) *v1.Pod {
+	pod := &v1.Pod{}
+	require.NoError(t, yaml.Unmarshal([]byte(render(t, chartRelPath, "templates/tests/test-vcenter.yaml", values)), pod))
+	require.Equal(t, "Pod", pod.Kind)
+	return pod
+}
+
+// TestCPITestPod runs the check of the CPI test pod with the rendered vsphere.yaml and
+// credentials Secret mounted.
+func TestCPITestPod(t *testing.T) {
+	for _, tt := range hookTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			password := cmp.Or(tt.args.password, password)
+			vc := startVCenter(t, password)
+			values := map[string]string{
+				"vCenter.host":         vc.host,
+				"vCenter.port":         vc.port,
+				"vCenter.username":     username,
+				"vCenter.password":     password,
+				"vCenter.insecureFlag": boolValue(tt.args.insecure),
+				"vCenter.datacenters":  strings.ReplaceAll(tt.args.datacenters, ",", `\,`),
+			}
+			values = withValues(values, tt.args.values)
+			configMap := &v1.ConfigMap{}
+			require.NoError(t, yaml.Unmarshal([]byte(render(t, cpiChart, "templates/configmap.yaml", values)), configMap))
+			secret := renderSecret(t, cpiChart, "templates/secret.yaml", values)
+			pod := renderPod(t, cpiChart, values)
+
+			dir := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc", "cloud"), 0o700))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "etc", "cloud", "vsphere.yaml"), []byte(configMap.Data["vsphere.yaml"]), 0o600))
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc", "vsphere-credentials"), 0o700))
+			for key, value := range secret.Data {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "etc", "vsphere-credentials", key), value, 0o600))
+			}
+
+			// act
+			output, err := runHook(t, pod, dir)
+
+			// assert
+			require.Contains(t, output, tt.args.expectedOutput)
+			require.Equal(t, strings.HasPrefix(tt.args.expectedOutput, "OK"), err == nil, output)
+		})
+	}
+}
+
+// TestCSITestPod runs the check of the CSI test pod with the rendered csi-vsphere.conf
+// mounted.
+func TestCSITestPod(t *testing.T) {
+	for _, tt := range hookTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.args.cpiOnly {
+				t.Skip("the values only apply to the CPI")
+			}
+
+			// arrange
+			password := cmp.Or(tt.args.password, password)
+			vc := startVCenter(t, password)
+			insecureFlag := "0"
+			if tt.args.insecure {
+				insecureFlag = "1"
+			}
+			values := map[string]string{
+				"vCenter.clusterId":    "vcsim",
+				"vCenter.host":         vc.host,
+				"vCenter.port":         vc.port,
+				"vCenter.username":     username,
+				"vCenter.password":     password,
+				"vCenter.insecureFlag": insecureFlag,
+				"vCenter.datacenters":  strings.ReplaceAll(tt.args.datacenters, ",", `\,`),
+			}
+			values = withValues(values, tt.args.values)
+			secret := renderSecret(t, csiChart, "templates/secret.yaml", values)
+			pod := renderPod(t, csiChart, values)
+
+			dir := t.TempDir()
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "etc", "cloud"), 0o700))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "etc", "cloud", "csi-vsphere.conf"), secret.Data["csi-vsphere.conf"], 0o600))
+
+			// act
+			output, err := runHook(t, pod, dir)
+
+			// assert
+			require.Contains(t, output, tt.args.expectedOutput)
+			require.Equal(t, strings.HasPrefix(tt.args.expectedOutput, "OK"), err == nil, output)
+		})
+	}
+}